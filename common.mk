@@ -7,7 +7,7 @@ INFODIR = $(DESTDIR)$(PREFIX)/info
 SHAREDIR = $(DESTDIR)$(PREFIX)/share/govpn
 DOCDIR = $(DESTDIR)$(PREFIX)/share/doc/govpn
 
-all: govpn-client govpn-server govpn-verifier
+all: govpn-client govpn-server govpn-verifier govpn-ctl
 
 govpn-client:
 	GOPATH=$(GOPATH) go build -ldflags "$(LDFLAGS)" cypherpunks.ru/govpn/cmd/govpn-client
@@ -18,19 +18,22 @@ govpn-server:
 govpn-verifier:
 	GOPATH=$(GOPATH) go build -ldflags "$(LDFLAGS)" cypherpunks.ru/govpn/cmd/govpn-verifier
 
+govpn-ctl:
+	GOPATH=$(GOPATH) go build -ldflags "$(LDFLAGS)" cypherpunks.ru/govpn/cmd/govpn-ctl
+
 bench:
 	GOPATH=$(GOPATH) go test -benchmem -bench . cypherpunks.ru/govpn/...
 
 clean:
-	rm -f govpn-client govpn-server govpn-verifier
+	rm -f govpn-client govpn-server govpn-verifier govpn-ctl
 
 doc:
 	$(MAKE) -C doc
 
 install: all doc
 	mkdir -p $(BINDIR)
-	cp -f govpn-client govpn-server govpn-verifier $(BINDIR)
-	chmod 755 $(BINDIR)/govpn-client $(BINDIR)/govpn-server $(BINDIR)/govpn-verifier
+	cp -f govpn-client govpn-server govpn-verifier govpn-ctl $(BINDIR)
+	chmod 755 $(BINDIR)/govpn-client $(BINDIR)/govpn-server $(BINDIR)/govpn-verifier $(BINDIR)/govpn-ctl
 	mkdir -p $(INFODIR)
 	cp -f doc/govpn.info $(INFODIR)
 	chmod 644 $(INFODIR)/govpn.info
@@ -42,7 +45,7 @@ install: all doc
 	chmod 644 $(DOCDIR)/*
 
 install-strip: install
-	strip $(BINDIR)/govpn-client $(BINDIR)/govpn-server $(BINDIR)/govpn-verifier
+	strip $(BINDIR)/govpn-client $(BINDIR)/govpn-server $(BINDIR)/govpn-verifier $(BINDIR)/govpn-ctl
 
 dist:
 	./utils/makedist.sh $(VERSION)
@@ -0,0 +1,51 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"cypherpunks.ru/govpn"
+)
+
+var reconnecting chan struct{} = make(chan struct{})
+
+type ctlStatus struct {
+	Remote    *Remote
+	Connected bool
+	Peer      *govpn.Peer `json:",omitempty"`
+}
+
+func ctlHandle(cmd, arg string) (interface{}, error) {
+	switch cmd {
+	case "status":
+		status := ctlStatus{Remote: remote}
+		for _, peer := range knownPeers {
+			if *peer != nil {
+				status.Connected = true
+				status.Peer = *peer
+			}
+		}
+		return &status, nil
+	case "reconnect":
+		reconnecting <- struct{}{}
+		return nil, nil
+	}
+	return nil, errors.New("Unknown command: " + cmd)
+}
@@ -23,43 +23,131 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
 var (
-	remoteAddr  = flag.String("remote", "", "Remote server address")
-	proto       = flag.String("proto", "udp", "Protocol to use: udp or tcp")
-	ifaceName   = flag.String("iface", "tap0", "TAP network interface")
-	verifierRaw = flag.String("verifier", "", "Verifier")
-	keyPath     = flag.String("key", "", "Path to passphrase file")
-	upPath      = flag.String("up", "", "Path to up-script")
-	downPath    = flag.String("down", "", "Path to down-script")
-	stats       = flag.String("stats", "", "Enable stats retrieving on host:port")
-	proxyAddr   = flag.String("proxy", "", "Use HTTP proxy on host:port")
-	proxyAuth   = flag.String("proxy-auth", "", "user:password Basic proxy auth")
-	mtu         = flag.Int("mtu", govpn.MTUDefault, "MTU of TAP interface")
-	timeoutP    = flag.Int("timeout", 60, "Timeout seconds")
-	timeSync    = flag.Int("timesync", 0, "Time synchronization requirement")
-	noisy       = flag.Bool("noise", false, "Enable noise appending")
-	encless     = flag.Bool("encless", false, "Encryptionless mode")
-	cpr         = flag.Int("cpr", 0, "Enable constant KiB/sec out traffic rate")
-	egdPath     = flag.String("egd", "", "Optional path to EGD socket")
-	syslog      = flag.Bool("syslog", false, "Enable logging to syslog")
-	warranty    = flag.Bool("warranty", false, "Print warranty information")
+	remoteRandom = flag.Bool("remote-random", false, "Try remote servers in random order")
+	reconnect    = flag.Bool("reconnect", false, "Reconnect after connection loss instead of exiting")
+	reconnectMax = flag.Int("reconnect-max", 60, "Maximal delay between reconnections, seconds")
+	proto        = flag.String("proto", "udp", "Protocol to use: udp or tcp")
+	ifaceName    = flag.String("iface", "tap0", "TAP network interface")
+	modeRaw      = flag.String("mode", "tap", "Interface mode: tap or tun")
+	suiteRaw     = flag.String("suite", "salsa20poly1305", "Transport cipher suite: salsa20poly1305, chacha20poly1305 or xchacha20poly1305")
+	verifierRaw  = flag.String("verifier", "", "Verifier")
+	keyPath      = flag.String("key", "", "Path to passphrase file")
+	upPath       = flag.String("up", "", "Path to up-script")
+	downPath     = flag.String("down", "", "Path to down-script")
+	mtuChanged   = flag.String("mtu-changed", "", "Path to script called when path MTU discovery changes MTU")
+	stats        = flag.String("stats", "", "Enable stats retrieving on host:port")
+	ctlPath      = flag.String("ctl", "", "Enable control Unix domain socket on that path")
+	proxyAddr    = flag.String("proxy", "", "Use proxy: [http|socks5://][user:password@]host:port")
+	proxyAuth    = flag.String("proxy-auth", "", "user:password Basic proxy auth")
+	mtu          = flag.Int("mtu", 0, "MTU of TAP interface (default depends on mode)")
+	timeoutP     = flag.Int("timeout", 60, "Timeout seconds")
+	rekeyP       = flag.Int("rekey", 0, "In-band rekeying interval seconds, 0 to disable")
+	replayWindow = flag.Int("replay-window", govpn.ReplayWindowDefault, "UDP replay protection window size, packets")
+	timeSync     = flag.Int("timesync", 0, "Time synchronization requirement")
+	noisy        = flag.Bool("noise", false, "Enable noise appending")
+	encless      = flag.Bool("encless", false, "Encryptionless mode")
+	hybrid       = flag.Bool("hybrid", false, "Enable hybrid post-quantum key exchange")
+	framed       = flag.Bool("framed", false, "Enable length-prefixed framing over TCP")
+	pull         = flag.Bool("pull", false, "Call up-script only after receiving configuration pushed by server")
+	cpr          = flag.Int("cpr", 0, "Enable constant KiB/sec out traffic rate")
+	egdPath      = flag.String("egd", "", "Optional path to EGD socket")
+	syslog       = flag.Bool("syslog", false, "Enable logging to syslog")
+	warranty     = flag.Bool("warranty", false, "Print warranty information")
 
+	remotesRaw  remotesFlag
+	remotes     []*Remote
+	remote      *Remote
+	upRemote    string
+	established bool
 	conf        *govpn.PeerConf
 	tap         *govpn.TAP
+	tapMTU      int
 	timeout     int
-	firstUpCall bool = true
 	knownPeers  govpn.KnownPeers
 	idsCache    *govpn.MACCache
 )
 
+func init() {
+	flag.Var(&remotesRaw, "remote", "Remote server address, [proto://]host:port[?proxy=host:port], can be repeated")
+}
+
+// Call up-script either right now, or after the network configuration
+// is pushed by the server. It is not called again while we reconnect
+// to the same remote server. If remote server is changed, then
+// down-script is called for the previous one.
+func upCall(peer *govpn.Peer) {
+	addr := remote.Addr
+	if addr == upRemote {
+		return
+	}
+	up := func(env []string) {
+		prev := upRemote
+		upRemote = addr
+		go func() {
+			if prev != "" {
+				govpn.ScriptCall(*downPath, *ifaceName, prev)
+			}
+			govpn.ScriptCallEnv(*upPath, *ifaceName, addr, env)
+		}()
+	}
+	if !*pull {
+		up(peer.MTUEnv())
+		return
+	}
+	peer.PushHandler = func(pc *govpn.PushConf) {
+		govpn.Printf(
+			`[push-received remote="%s" addr4="%s" addr6="%s"]`,
+			addr, pc.Addr4, pc.Addr6,
+		)
+		up(append(pc.Env(), peer.MTUEnv()...))
+	}
+}
+
+// Adjust interface's MTU when it differs from the current one: either
+// because of smaller MTU negotiated in the handshake, or because of path
+// MTU discovery. Up-script already knows negotiated MTU, so optional
+// MTU changed script is called only after the discovery.
+func mtuStart(peer *govpn.Peer) {
+	mtuSet := func(mtu int) bool {
+		if err := tap.MTUSet(peer.IfaceMTU()); err != nil {
+			govpn.Printf(`[mtu-failed remote="%s" err="%s"]`, remote.Addr, err)
+			return false
+		}
+		tapMTU = mtu
+		govpn.Printf(`[mtu-changed remote="%s" mtu="%d"]`, remote.Addr, peer.IfaceMTU())
+		return true
+	}
+	if peer.MTU != tapMTU {
+		mtuSet(peer.MTU)
+	}
+	peer.MTUHandler = func(mtu int) {
+		if mtuSet(mtu) && *mtuChanged != "" {
+			go govpn.ScriptCallEnv(*mtuChanged, *ifaceName, remote.Addr, peer.MTUEnv())
+		}
+	}
+}
+
+// Tell the server that we are going away, so it does not wait for the
+// timeout.
+func goodbye(reason govpn.GoodbyeReason) {
+	for _, peer := range knownPeers {
+		if *peer != nil {
+			(*peer).Goodbye(reason)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 	if *warranty {
@@ -69,7 +157,30 @@ func main() {
 	timeout = *timeoutP
 	var err error
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+	rand.Seed(time.Now().UnixNano())
+
+	if len(remotesRaw) == 0 {
+		log.Fatalln("No remote specified")
+	}
+	for _, spec := range remotesRaw {
+		remote, err = remoteParse(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		remotes = append(remotes, remote)
+	}
 
+	mode, err := govpn.ModeFromString(*modeRaw)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	suite, err := govpn.SuiteFromString(*suiteRaw)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *mtu == 0 {
+		*mtu = govpn.MTUDefaultFor(mode)
+	}
 	if *mtu > govpn.MTUMax {
 		log.Fatalln("Maximum allowable MTU is", govpn.MTUMax)
 	}
@@ -91,32 +202,55 @@ func main() {
 	}
 	priv := verifier.PasswordApply(key)
 	if *encless {
-		if *proto != "tcp" {
-			log.Fatalln("Currently encryptionless mode works only with TCP")
+		for _, remote := range remotes {
+			if remote.Proto == "udp" {
+				log.Fatalln("Currently encryptionless mode works only with TCP or WebSocket")
+			}
 		}
 		*noisy = true
 	}
+	if *framed {
+		for _, remote := range remotes {
+			if remote.Proto != "tcp" {
+				log.Fatalln("Length-prefixed framing works only with TCP")
+			}
+		}
+	}
+	if *replayWindow <= 0 {
+		log.Fatalln("Replay window must be positive")
+	}
+	if *hybrid && *noisy && *mtu < govpn.KEMMTUMin {
+		log.Fatalln("Minimal MTU for noised hybrid handshake is", govpn.KEMMTUMin)
+	}
 	conf = &govpn.PeerConf{
 		Id:       verifier.Id,
 		Iface:    *ifaceName,
 		MTU:      *mtu,
+		Mode:     mode,
 		Timeout:  time.Second * time.Duration(timeout),
+		Rekey:    time.Second * time.Duration(*rekeyP),
 		TimeSync: *timeSync,
 		Noise:    *noisy,
 		CPR:      *cpr,
 		Encless:  *encless,
+		Hybrid:   *hybrid,
+		Framed:   *framed,
 		Verifier: verifier,
 		DSAPriv:  priv,
+		Suite:    suite,
+
+		ReplayWindow: *replayWindow,
 	}
 	idsCache = govpn.NewMACCache()
 	confs := map[govpn.PeerId]*govpn.PeerConf{*verifier.Id: conf}
 	idsCache.Update(&confs)
 	log.Println(govpn.VersionGet())
 
-	tap, err = govpn.TAPListen(*ifaceName, *mtu)
+	tap, err = govpn.TAPListen(*ifaceName, *mtu, mode)
 	if err != nil {
 		log.Fatalln("Can not listen on TAP interface:", err)
 	}
+	tapMTU = *mtu
 
 	if *stats != "" {
 		log.Println("Stats are going to listen on", *stats)
@@ -124,7 +258,16 @@ func main() {
 		if err != nil {
 			log.Fatalln("Can not listen on stats port:", err)
 		}
-		go govpn.StatsProcessor(statsPort, &knownPeers)
+		go govpn.StatsProcessor(statsPort, &knownPeers, nil)
+	}
+
+	if *ctlPath != "" {
+		log.Println("Control socket is going to listen on", *ctlPath)
+		ctl, err := govpn.CtlListen(*ctlPath)
+		if err != nil {
+			log.Fatalln("Can not listen on control socket:", err)
+		}
+		go govpn.CtlProcessor(ctl, ctlHandle)
 	}
 
 	if *syslog {
@@ -132,40 +275,68 @@ func main() {
 	}
 
 	termSignal := make(chan os.Signal, 1)
-	signal.Notify(termSignal, os.Interrupt, os.Kill)
+	signal.Notify(termSignal, os.Interrupt, syscall.SIGTERM)
+
+	remoteIdx := 0
+	if *remoteRandom {
+		remoteIdx = rand.Intn(len(remotes))
+	}
+	delay := ReconnectMin
+	var wait time.Duration
 
 MainCycle:
 	for {
+		remote = remotes[remoteIdx]
+		established = false
 		timeouted := make(chan struct{})
 		rehandshaking := make(chan struct{})
 		termination := make(chan struct{})
-		if *proxyAddr != "" {
-			*proto = "tcp"
-		}
-		switch *proto {
+		switch remote.Proto {
 		case "udp":
 			go startUDP(timeouted, rehandshaking, termination)
 		case "tcp":
-			if *proxyAddr != "" {
+			if remote.Proxy != "" {
 				go proxyTCP(timeouted, rehandshaking, termination)
 			} else {
 				go startTCP(timeouted, rehandshaking, termination)
 			}
-		default:
-			log.Fatalln("Unknown protocol specified")
+		case "ws":
+			go startWS(timeouted, rehandshaking, termination)
 		}
 		select {
 		case <-termSignal:
-			govpn.BothPrintf(`[finish remote="%s"]`, *remoteAddr)
+			govpn.BothPrintf(`[finish remote="%s"]`, remote.Addr)
+			goodbye(govpn.GoodbyeShutdown)
 			termination <- struct{}{}
 			break MainCycle
 		case <-timeouted:
-			break MainCycle
+			if !*reconnect {
+				break MainCycle
+			}
+			remoteIdx, wait, delay = reconnectNext(remoteIdx, delay, established)
+			govpn.Printf(
+				`[reconnect-wait remote="%s" delay="%s"]`,
+				remotes[remoteIdx].Addr, wait,
+			)
+			select {
+			case <-termSignal:
+				govpn.BothPrintf(`[finish remote="%s"]`, remote.Addr)
+				break MainCycle
+			case <-reconnecting:
+			case <-time.After(wait):
+			}
 		case <-rehandshaking:
+		case <-reconnecting:
+			govpn.Printf(`[reconnect remote="%s"]`, remote.Addr)
+			goodbye(govpn.GoodbyeReconnect)
+			termination <- struct{}{}
 		}
 		close(timeouted)
 		close(rehandshaking)
 		close(termination)
 	}
-	govpn.ScriptCall(*downPath, *ifaceName, *remoteAddr)
+	if upRemote == "" {
+		upRemote = remote.Addr
+	}
+	govpn.ScriptCall(*downPath, *ifaceName, upRemote)
 }
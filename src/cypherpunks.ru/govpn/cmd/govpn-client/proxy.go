@@ -19,39 +19,22 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
-	"log"
-	"net"
-	"net/http"
-
 	"cypherpunks.ru/govpn"
 )
 
 func proxyTCP(timeouted, rehandshaking, termination chan struct{}) {
-	proxyAddr, err := net.ResolveTCPAddr("tcp", *proxyAddr)
-	if err != nil {
-		log.Fatalln("Can not resolve proxy address:", err)
-	}
-	conn, err := net.DialTCP("tcp", nil, proxyAddr)
+	conn, err := govpn.ProxyDial(remote.Proxy, *proxyAuth, remote.Addr)
 	if err != nil {
-		log.Fatalln("Can not connect to proxy:", err)
+		govpn.Printf(
+			`[proxy-connect-failed remote="%s" addr="%s" err="%s"]`,
+			remote.Addr, govpn.ProxyRedact(remote.Proxy), err,
+		)
+		timeouted <- struct{}{}
+		return
 	}
-	req := "CONNECT " + *remoteAddr + " HTTP/1.1\n"
-	req += "Host: " + *remoteAddr + "\n"
-	if *proxyAuth != "" {
-		req += "Proxy-Authorization: Basic "
-		req += base64.StdEncoding.EncodeToString([]byte(*proxyAuth)) + "\n"
-	}
-	req += "\n"
-	conn.Write([]byte(req))
-	resp, err := http.ReadResponse(
-		bufio.NewReader(conn),
-		&http.Request{Method: "CONNECT"},
+	govpn.Printf(
+		`[proxy-connected remote="%s" addr="%s"]`,
+		remote.Addr, govpn.ProxyRedact(remote.Proxy),
 	)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		log.Fatalln("Unexpected response from proxy")
-	}
-	govpn.Printf(`[proxy-connected remote="%s" addr="%s"]`, *remoteAddr, *proxyAddr)
 	go handleTCP(conn, timeouted, rehandshaking, termination)
 }
@@ -0,0 +1,123 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	ReconnectMin = time.Second
+)
+
+// Remote server we can connect to.
+type Remote struct {
+	Addr  string
+	Proto string
+	Proxy string `json:",omitempty"`
+}
+
+// Proxy's password is not shown.
+func (r *Remote) MarshalJSON() ([]byte, error) {
+	shown := *r
+	shown.Proxy = govpn.ProxyRedact(r.Proxy)
+	return json.Marshal(remoteJSON(shown))
+}
+
+// Remote without MarshalJSON method, to prevent recursion.
+type remoteJSON Remote
+
+// Repeatable -remote option.
+type remotesFlag []string
+
+func (r *remotesFlag) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *remotesFlag) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+// Parse remote server specification in [proto://]host:port[?proxy=host:port]
+// format. Omitted protocol and proxy are taken from -proto and -proxy.
+// ws:// and wss:// URLs are used as is for WebSocket transport.
+func remoteParse(spec string) (*Remote, error) {
+	if strings.HasPrefix(spec, "ws://") || strings.HasPrefix(spec, "wss://") {
+		return &Remote{Addr: spec, Proto: "ws"}, nil
+	}
+	remote := Remote{Proto: *proto, Proxy: *proxyAddr}
+	if i := strings.Index(spec, "?proxy="); i != -1 {
+		remote.Proxy = spec[i+len("?proxy="):]
+		spec = spec[:i]
+	}
+	if i := strings.Index(spec, "://"); i != -1 {
+		remote.Proto = spec[:i]
+		spec = spec[i+3:]
+	}
+	if remote.Proxy != "" {
+		remote.Proto = "tcp"
+	}
+	if remote.Proto != "udp" && remote.Proto != "tcp" {
+		return nil, errors.New("Unknown protocol specified: " + remote.Proto)
+	}
+	if spec == "" {
+		return nil, errors.New("No remote address specified")
+	}
+	remote.Addr = spec
+	return &remote, nil
+}
+
+// Choose the remote to connect to after the current one.
+func remoteNext(i int) int {
+	if *remoteRandom && len(remotes) > 1 {
+		return rand.Intn(len(remotes))
+	}
+	return (i + 1) % len(remotes)
+}
+
+// Exponentially grow reconnection delay, with ±25% jitter.
+func backoffNext(delay time.Duration) (time.Duration, time.Duration) {
+	wait := delay - delay/4 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	delay *= 2
+	if max := time.Duration(*reconnectMax) * time.Second; delay > max {
+		delay = max
+	}
+	if delay < ReconnectMin {
+		delay = ReconnectMin
+	}
+	return wait, delay
+}
+
+// Choose the remote and the delay before reconnecting to it. Delay is
+// reset if the session was established, so only consecutive failures
+// grow it.
+func reconnectNext(i int, delay time.Duration, established bool) (int, time.Duration, time.Duration) {
+	if established {
+		delay = ReconnectMin
+	}
+	wait, delay := backoffNext(delay)
+	return remoteNext(i), wait, delay
+}
@@ -0,0 +1,131 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	maxPrev := *reconnectMax
+	defer func() { *reconnectMax = maxPrev }()
+	*reconnectMax = 60
+	for _, c := range []struct{ delay, next time.Duration }{
+		{ReconnectMin, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{16 * time.Second, 32 * time.Second},
+		{32 * time.Second, time.Minute},
+		{time.Minute, time.Minute},
+		{0, ReconnectMin},
+	} {
+		waits := make(map[time.Duration]struct{})
+		for i := 0; i < 1000; i++ {
+			wait, next := backoffNext(c.delay)
+			if next != c.next {
+				t.Fatal("delay", c.delay, "is followed by", next, "instead of", c.next)
+			}
+			if wait < c.delay-c.delay/4 || wait > c.delay+c.delay/4 {
+				t.Fatal("wait", wait, "is out of jitter bounds for", c.delay)
+			}
+			waits[wait] = struct{}{}
+		}
+		if c.delay > 0 && len(waits) < 2 {
+			t.Fatal("no jitter for", c.delay)
+		}
+	}
+}
+
+func TestBackoffNextMaxSmall(t *testing.T) {
+	maxPrev := *reconnectMax
+	defer func() { *reconnectMax = maxPrev }()
+	*reconnectMax = 0
+	if _, next := backoffNext(4 * time.Second); next != ReconnectMin {
+		t.Fatal("delay is less than minimal", next)
+	}
+}
+
+func TestRemoteNext(t *testing.T) {
+	remotesPrev, randomPrev := remotes, *remoteRandom
+	defer func() { remotes, *remoteRandom = remotesPrev, randomPrev }()
+	remotes = []*Remote{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}
+	*remoteRandom = false
+	for _, c := range []struct{ i, next int }{
+		{0, 1},
+		{1, 2},
+		{2, 0},
+	} {
+		if next := remoteNext(c.i); next != c.next {
+			t.Fatal("remote", c.i, "is followed by", next, "instead of", c.next)
+		}
+	}
+
+	*remoteRandom = true
+	seen := make(map[int]struct{})
+	for i := 0; i < 1000; i++ {
+		next := remoteNext(0)
+		if next < 0 || next >= len(remotes) {
+			t.Fatal("random remote is out of range", next)
+		}
+		seen[next] = struct{}{}
+	}
+	if len(seen) != len(remotes) {
+		t.Fatal("not all remotes are tried", seen)
+	}
+
+	remotes = remotes[:1]
+	if next := remoteNext(0); next != 0 {
+		t.Fatal("single remote is not reused", next)
+	}
+}
+
+func TestReconnectNext(t *testing.T) {
+	maxPrev, remotesPrev, randomPrev := *reconnectMax, remotes, *remoteRandom
+	defer func() {
+		*reconnectMax, remotes, *remoteRandom = maxPrev, remotesPrev, randomPrev
+	}()
+	*reconnectMax = 60
+	*remoteRandom = false
+	remotes = []*Remote{{Addr: "a"}, {Addr: "b"}}
+	for _, c := range []struct {
+		i           int
+		delay       time.Duration
+		established bool
+		next        int
+		delayNext   time.Duration
+	}{
+		{0, ReconnectMin, false, 1, 2 * time.Second},
+		{1, 2 * time.Second, false, 0, 4 * time.Second},
+		{0, 32 * time.Second, false, 1, time.Minute},
+		{0, 32 * time.Second, true, 1, 2 * time.Second},
+		{1, time.Minute, true, 0, 2 * time.Second},
+	} {
+		next, wait, delay := reconnectNext(c.i, c.delay, c.established)
+		if next != c.next || delay != c.delayNext {
+			t.Fatal("unexpected reconnection", c, next, delay)
+		}
+		waitDelay := c.delay
+		if c.established {
+			waitDelay = ReconnectMin
+		}
+		if wait < waitDelay-waitDelay/4 || wait > waitDelay+waitDelay/4 {
+			t.Fatal("wait", wait, "is out of jitter bounds", c)
+		}
+	}
+}
@@ -20,34 +20,41 @@ package main
 
 import (
 	"bytes"
-	"log"
 	"net"
-	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
 func startTCP(timeouted, rehandshaking, termination chan struct{}) {
-	remote, err := net.ResolveTCPAddr("tcp", *remoteAddr)
+	raddr, err := net.ResolveTCPAddr("tcp", remote.Addr)
 	if err != nil {
-		log.Fatalln("Can not resolve remote address:", err)
+		govpn.Printf(`[resolve-failed remote="%s" err="%s"]`, remote.Addr, err)
+		timeouted <- struct{}{}
+		return
 	}
-	conn, err := net.DialTCP("tcp", nil, remote)
+	conn, err := net.DialTCP("tcp", nil, raddr)
 	if err != nil {
-		log.Fatalln("Can not connect to address:", err)
+		govpn.Printf(`[connect-failed remote="%s" err="%s"]`, remote.Addr, err)
+		timeouted <- struct{}{}
+		return
 	}
-	govpn.Printf(`[connected remote="%s"]`, *remoteAddr)
+	govpn.Printf(`[connected remote="%s"]`, remote.Addr)
 	handleTCP(conn, timeouted, rehandshaking, termination)
 }
 
-func handleTCP(conn *net.TCPConn, timeouted, rehandshaking, termination chan struct{}) {
-	hs := govpn.HandshakeStart(*remoteAddr, conn, conf)
+func handleTCP(conn net.Conn, timeouted, rehandshaking, termination chan struct{}) {
+	defer conn.Close()
+	hs := govpn.HandshakeStart(remote.Addr, conn, conf)
 	buf := make([]byte, 2*(govpn.EnclessEnlargeSize+*mtu)+*mtu)
 	var n int
 	var err error
 	var prev int
+	var size int
+	var replied bool
 	var peer *govpn.Peer
+	var gone bool
+	var reason govpn.GoodbyeReason
 	var terminator chan struct{}
 HandshakeCycle:
 	for {
@@ -57,7 +64,7 @@ HandshakeCycle:
 		default:
 		}
 		if prev == len(buf) {
-			govpn.Printf(`[packet-timeouted remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[packet-timeouted remote="%s"]`, remote.Addr)
 			timeouted <- struct{}{}
 			break HandshakeCycle
 		}
@@ -65,26 +72,35 @@ HandshakeCycle:
 		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 		n, err = conn.Read(buf[prev:])
 		if err != nil {
-			govpn.Printf(`[connection-timeouted remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[connection-timeouted remote="%s"]`, remote.Addr)
 			timeouted <- struct{}{}
 			break HandshakeCycle
 		}
 
 		prev += n
-		peerId := idsCache.Find(buf[:prev])
+		size = prev
+		// Framed packets can immediately follow the final message
+		if replied && conf.Framed && size > hs.FinalSize() {
+			size = hs.FinalSize()
+		}
+		peerId := idsCache.Find(buf[:size])
 		if peerId == nil {
 			continue
 		}
-		peer = hs.Client(buf[:prev])
-		prev = 0
+		peer = hs.Client(buf[:size])
+		copy(buf, buf[size:prev])
+		prev -= size
+		replied = true
 		if peer == nil {
 			continue
 		}
-		govpn.Printf(`[handshake-completed remote="%s"]`, *remoteAddr)
-		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{*remoteAddr: &peer})
-		if firstUpCall {
-			go govpn.ScriptCall(*upPath, *ifaceName, *remoteAddr)
-			firstUpCall = false
+		govpn.Printf(`[handshake-completed remote="%s"]`, remote.Addr)
+		established = true
+		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{remote.Addr: &peer})
+		upCall(peer)
+		mtuStart(peer)
+		peer.GoodbyeHandler = func(r govpn.GoodbyeReason) {
+			gone, reason = true, r
 		}
 		hs.Zero()
 		terminator = make(chan struct{})
@@ -98,8 +114,8 @@ HandshakeCycle:
 		return
 	}
 
-	prev = 0
 	var i int
+	var pkt []byte
 TransportCycle:
 	for {
 		select {
@@ -107,19 +123,53 @@ TransportCycle:
 			break TransportCycle
 		default:
 		}
+		if peer.Framed {
+			pkt, i = peer.FrameNext(buf[:prev], len(buf))
+			if i < 0 {
+				govpn.Printf(`[packet-too-big remote="%s"]`, remote.Addr)
+				timeouted <- struct{}{}
+				break TransportCycle
+			}
+			if i > 0 {
+				if !peer.PktProcess(pkt, tap, false) {
+					govpn.Printf(`[packet-unauthenticated remote="%s"]`, remote.Addr)
+					timeouted <- struct{}{}
+					break TransportCycle
+				}
+				if gone {
+					govpn.Printf(
+						`[goodbye-received remote="%s" reason="%s"]`,
+						remote.Addr, reason,
+					)
+					timeouted <- struct{}{}
+					break TransportCycle
+				}
+				if peer.KeyBytes() > govpn.MaxBytesPerKey {
+					govpn.Printf(`[rehandshake-required remote="%s"]`, remote.Addr)
+					rehandshaking <- struct{}{}
+					break TransportCycle
+				}
+				copy(buf, buf[i:prev])
+				prev -= i
+				continue
+			}
+		}
 		if prev == len(buf) {
-			govpn.Printf(`[packet-timeouted remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[packet-timeouted remote="%s"]`, remote.Addr)
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
 		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 		n, err = conn.Read(buf[prev:])
 		if err != nil {
-			govpn.Printf(`[connection-timeouted remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[connection-timeouted remote="%s"]`, remote.Addr)
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
 		prev += n
+		if peer.Framed {
+			continue
+		}
 	CheckMore:
 		if prev < govpn.MinPktLength {
 			continue
@@ -129,12 +179,20 @@ TransportCycle:
 			continue
 		}
 		if !peer.PktProcess(buf[:i+govpn.NonceSize], tap, false) {
-			govpn.Printf(`[packet-unauthenticated remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[packet-unauthenticated remote="%s"]`, remote.Addr)
+			timeouted <- struct{}{}
+			break TransportCycle
+		}
+		if gone {
+			govpn.Printf(
+				`[goodbye-received remote="%s" reason="%s"]`,
+				remote.Addr, reason,
+			)
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
-		if atomic.LoadUint64(&peer.BytesIn)+atomic.LoadUint64(&peer.BytesOut) > govpn.MaxBytesPerKey {
-			govpn.Printf(`[rehandshake-required remote="%s"]`, *remoteAddr)
+		if peer.KeyBytes() > govpn.MaxBytesPerKey {
+			govpn.Printf(`[rehandshake-required remote="%s"]`, remote.Addr)
 			rehandshaking <- struct{}{}
 			break TransportCycle
 		}
@@ -143,8 +201,7 @@ TransportCycle:
 		goto CheckMore
 	}
 	if terminator != nil {
-		terminator <- struct{}{}
+		close(terminator)
 	}
 	peer.Zero()
-	conn.Close()
 }
@@ -19,30 +19,59 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"log"
 	"net"
-	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
+// Connected UDP socket able to send packets in batches.
+type udpSender struct {
+	*net.UDPConn
+	batch *govpn.UDPBatch
+	msgs  []govpn.UDPMsg
+}
+
+func (c *udpSender) WriteBatch(pkts [][]byte) error {
+	msgs := c.msgs[:len(pkts)]
+	for i, pkt := range pkts {
+		msgs[i] = govpn.UDPMsg{Buf: pkt, N: len(pkt)}
+	}
+	return c.batch.Write(msgs)
+}
+
 func startUDP(timeouted, rehandshaking, termination chan struct{}) {
-	remote, err := net.ResolveUDPAddr("udp", *remoteAddr)
+	raddr, err := net.ResolveUDPAddr("udp", remote.Addr)
 	if err != nil {
-		log.Fatalln("Can not resolve remote address:", err)
+		govpn.Printf(`[resolve-failed remote="%s" err="%s"]`, remote.Addr, err)
+		timeouted <- struct{}{}
+		return
 	}
-	conn, err := net.DialUDP("udp", nil, remote)
+	conn, err := net.DialUDP("udp", nil, raddr)
 	if err != nil {
-		log.Fatalln("Can not listen on UDP:", err)
+		govpn.Printf(`[connect-failed remote="%s" err="%s"]`, remote.Addr, err)
+		timeouted <- struct{}{}
+		return
 	}
-	govpn.Printf(`[connected remote="%s"]`, *remoteAddr)
+	govpn.Printf(`[connected remote="%s"]`, remote.Addr)
 
-	hs := govpn.HandshakeStart(*remoteAddr, conn, conf)
-	buf := make([]byte, *mtu*2)
-	var n int
+	sender := &udpSender{
+		UDPConn: conn,
+		batch:   govpn.NewUDPBatch(conn),
+		msgs:    make([]govpn.UDPMsg, govpn.UDPBatchSize),
+	}
+	hs := govpn.HandshakeStart(remote.Addr, sender, conf)
+	batch := govpn.NewUDPBatch(conn)
+	msgs := make([]govpn.UDPMsg, govpn.UDPBatchSize)
+	for i := 0; i < len(msgs); i++ {
+		msgs[i].Buf = make([]byte, *mtu*2)
+	}
+	var buf []byte
+	var n, cnt int
 	var timeouts int
 	var peer *govpn.Peer
+	var gone bool
+	var reason govpn.GoodbyeReason
 	var terminator chan struct{}
 MainCycle:
 	for {
@@ -53,9 +82,9 @@ MainCycle:
 		}
 
 		conn.SetReadDeadline(time.Now().Add(time.Second))
-		n, err = conn.Read(buf)
+		cnt, err = batch.Read(msgs)
 		if timeouts == timeout {
-			govpn.Printf(`[connection-timeouted remote="%s"]`, *remoteAddr)
+			govpn.Printf(`[connection-timeouted remote="%s"]`, remote.Addr)
 			timeouted <- struct{}{}
 			break
 		}
@@ -63,41 +92,55 @@ MainCycle:
 			timeouts++
 			continue
 		}
-		if peer != nil {
-			if peer.PktProcess(buf[:n], tap, true) {
-				timeouts = 0
-			} else {
-				govpn.Printf(`[packet-unauthenticated remote="%s"]`, *remoteAddr)
-				timeouts++
+		for i := 0; i < cnt; i++ {
+			buf, n = msgs[i].Buf, msgs[i].N
+			if peer != nil {
+				if peer.PktProcess(buf[:n], tap, true) {
+					timeouts = 0
+				} else {
+					govpn.Printf(`[packet-unauthenticated remote="%s"]`, remote.Addr)
+					timeouts++
+				}
+				if gone {
+					govpn.Printf(
+						`[goodbye-received remote="%s" reason="%s"]`,
+						remote.Addr, reason,
+					)
+					timeouted <- struct{}{}
+					break MainCycle
+				}
+				if peer.KeyBytes() > govpn.MaxBytesPerKey {
+					govpn.Printf(`[rehandshake-required remote="%s"]`, remote.Addr)
+					rehandshaking <- struct{}{}
+					break MainCycle
+				}
+				continue
 			}
-			if atomic.LoadUint64(&peer.BytesIn)+atomic.LoadUint64(&peer.BytesOut) > govpn.MaxBytesPerKey {
-				govpn.Printf(`[rehandshake-required remote="%s"]`, *remoteAddr)
-				rehandshaking <- struct{}{}
-				break MainCycle
+			if idsCache.Find(buf[:n]) == nil {
+				govpn.Printf(`[identity-invalid remote="%s"]`, remote.Addr)
+				continue
 			}
-			continue
-		}
-		if idsCache.Find(buf[:n]) == nil {
-			govpn.Printf(`[identity-invalid remote="%s"]`, *remoteAddr)
-			continue
-		}
-		timeouts = 0
-		peer = hs.Client(buf[:n])
-		if peer == nil {
-			continue
-		}
-		govpn.Printf(`[handshake-completed remote="%s"]`, *remoteAddr)
-		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{*remoteAddr: &peer})
-		if firstUpCall {
-			go govpn.ScriptCall(*upPath, *ifaceName, *remoteAddr)
-			firstUpCall = false
+			timeouts = 0
+			peer = hs.Client(buf[:n])
+			if peer == nil {
+				continue
+			}
+			govpn.Printf(`[handshake-completed remote="%s"]`, remote.Addr)
+			established = true
+			knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{remote.Addr: &peer})
+			peer.PMTUDiscovery = true
+			upCall(peer)
+			mtuStart(peer)
+			peer.GoodbyeHandler = func(r govpn.GoodbyeReason) {
+				gone, reason = true, r
+			}
+			hs.Zero()
+			terminator = make(chan struct{})
+			go govpn.PeerTapProcessor(peer, tap, terminator)
 		}
-		hs.Zero()
-		terminator = make(chan struct{})
-		go govpn.PeerTapProcessor(peer, tap, terminator)
 	}
 	if terminator != nil {
-		terminator <- struct{}{}
+		close(terminator)
 	}
 	if hs != nil {
 		hs.Zero()
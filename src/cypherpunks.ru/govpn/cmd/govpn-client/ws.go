@@ -0,0 +1,112 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+func startWS(timeouted, rehandshaking, termination chan struct{}) {
+	conn, err := govpn.WSDial(remote.Addr)
+	if err != nil {
+		govpn.Printf(`[connect-failed remote="%s" err="%s"]`, remote.Addr, err)
+		timeouted <- struct{}{}
+		return
+	}
+	govpn.Printf(`[connected remote="%s"]`, remote.Addr)
+	handleWS(conn, timeouted, rehandshaking, termination)
+}
+
+// Each WebSocket message carries single packet, so no frame scanning
+// is required, unlike with TCP.
+func handleWS(conn *govpn.WSConn, timeouted, rehandshaking, termination chan struct{}) {
+	hs := govpn.HandshakeStart(remote.Addr, conn, conf)
+	buf := make([]byte, 2*(govpn.EnclessEnlargeSize+*mtu)+*mtu)
+	var n int
+	var err error
+	var peer *govpn.Peer
+	var gone bool
+	var reason govpn.GoodbyeReason
+	var terminator chan struct{}
+MainCycle:
+	for {
+		select {
+		case <-termination:
+			break MainCycle
+		default:
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		n, err = conn.Read(buf)
+		if err != nil {
+			govpn.Printf(`[connection-timeouted remote="%s"]`, remote.Addr)
+			timeouted <- struct{}{}
+			break MainCycle
+		}
+		if peer != nil {
+			if !peer.PktProcess(buf[:n], tap, false) {
+				govpn.Printf(`[packet-unauthenticated remote="%s"]`, remote.Addr)
+				timeouted <- struct{}{}
+				break MainCycle
+			}
+			if gone {
+				govpn.Printf(
+					`[goodbye-received remote="%s" reason="%s"]`,
+					remote.Addr, reason,
+				)
+				timeouted <- struct{}{}
+				break MainCycle
+			}
+			if peer.KeyBytes() > govpn.MaxBytesPerKey {
+				govpn.Printf(`[rehandshake-required remote="%s"]`, remote.Addr)
+				rehandshaking <- struct{}{}
+				break MainCycle
+			}
+			continue
+		}
+		if idsCache.Find(buf[:n]) == nil {
+			govpn.Printf(`[identity-invalid remote="%s"]`, remote.Addr)
+			continue
+		}
+		peer = hs.Client(buf[:n])
+		if peer == nil {
+			continue
+		}
+		govpn.Printf(`[handshake-completed remote="%s"]`, remote.Addr)
+		established = true
+		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{remote.Addr: &peer})
+		upCall(peer)
+		mtuStart(peer)
+		peer.GoodbyeHandler = func(r govpn.GoodbyeReason) {
+			gone, reason = true, r
+		}
+		hs.Zero()
+		terminator = make(chan struct{})
+		go govpn.PeerTapProcessor(peer, tap, terminator)
+	}
+	if terminator != nil {
+		close(terminator)
+	}
+	hs.Zero()
+	if peer != nil {
+		peer.Zero()
+	}
+	conn.Close()
+}
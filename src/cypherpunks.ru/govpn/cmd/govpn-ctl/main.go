@@ -0,0 +1,71 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Administration utility for GoVPN daemons' control sockets.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	ctlPath  = flag.String("ctl", "", "Path to control Unix domain socket")
+	warranty = flag.Bool("warranty", false, "Print warranty information")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -ctl PATH COMMAND [ARG]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Server commands: peers, handshakes, stats PEER, counters, kick PEER, rekey PEER, reload")
+		fmt.Fprintln(os.Stderr, "Client commands: status, reconnect")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *warranty {
+		fmt.Println(govpn.Warranty)
+		return
+	}
+	if *ctlPath == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	resp, err := govpn.CtlRequest(*ctlPath, flag.Arg(0), strings.Join(flag.Args()[1:], " "))
+	if err != nil {
+		log.Fatalln("Control request failed:", err)
+	}
+	if !resp.Ok {
+		log.Fatalln(resp.Error)
+	}
+	if resp.Data == nil {
+		fmt.Println("OK")
+		return
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, resp.Data, "", "  "); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(out.String())
+}
@@ -0,0 +1,207 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	// CPR with smaller MTU results in too high packet rate
+	CheckCPRMTU = 1280
+)
+
+var yamlErrLine = regexp.MustCompile(`line (\d+): `)
+
+// Problem found in configuration file.
+type checkIssue struct {
+	line    int
+	warning bool
+	msg     string
+}
+
+type checkIssues []checkIssue
+
+func (is checkIssues) Len() int           { return len(is) }
+func (is checkIssues) Less(i, j int) bool { return is[i].line < is[j].line }
+func (is checkIssues) Swap(i, j int)      { is[i], is[j] = is[j], is[i] }
+
+// Find line numbers of top-level keys, that are peers' names.
+func confLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	for i, l := range strings.Split(string(data), "\n") {
+		if l == "" || l[0] == ' ' || l[0] == '\t' || l[0] == '#' {
+			continue
+		}
+		idx := strings.Index(l, ":")
+		if idx <= 0 {
+			continue
+		}
+		name := strings.Trim(strings.TrimSpace(l[:idx]), `"'`)
+		if _, exists := lines[name]; !exists {
+			lines[name] = i + 1
+		}
+	}
+	return lines
+}
+
+// Check that script exists and can be executed.
+func scriptCheck(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("Script is not a regular file: " + path)
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return errors.New("Script is not executable: " + path)
+	}
+	return nil
+}
+
+func checkPrint(w io.Writer, is checkIssue) {
+	kind := "error"
+	if is.warning {
+		kind = "warning"
+	}
+	if is.line == 0 {
+		fmt.Fprintf(w, "%s: %s: %s\n", *confPath, kind, is.msg)
+	} else {
+		fmt.Fprintf(w, "%s:%d: %s: %s\n", *confPath, is.line, kind, is.msg)
+	}
+}
+
+// Check configuration file more strictly than it is done when it is
+// loaded, reporting all found errors and warnings with line numbers to
+// w. Exit code is returned: non-zero if there are errors.
+func confCheck(w io.Writer) int {
+	data, err := ioutil.ReadFile(*confPath)
+	if err != nil {
+		checkPrint(w, checkIssue{msg: err.Error()})
+		return 1
+	}
+	confsRaw := make(map[string]govpn.PeerConf)
+	if err = yaml.Unmarshal(data, &confsRaw); err != nil {
+		is := checkIssue{msg: err.Error()}
+		if m := yamlErrLine.FindStringSubmatch(is.msg); m != nil {
+			is.line, _ = strconv.Atoi(m[1])
+			is.msg = strings.Replace(is.msg, m[0], "", 1)
+		}
+		checkPrint(w, is)
+		return 1
+	}
+	lines := confLines(data)
+	var issues checkIssues
+	issue := func(name string, warning bool, format string, a ...interface{}) {
+		issues = append(issues, checkIssue{
+			line:    lines[name],
+			warning: warning,
+			msg:     name + ": " + fmt.Sprintf(format, a...),
+		})
+	}
+
+	names := make([]string, 0, len(confsRaw))
+	for name := range confsRaw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ids := make(map[govpn.PeerId]string)
+	ifaces := make(map[string]string)
+	shares := newConfShares()
+	synced, syncKnown := clockSynced()
+	for _, name := range names {
+		pc := confsRaw[name]
+		if pc.Iface == "" && pc.Up == "" && pc.Switch == "" {
+			issue(name, false, "neither iface, nor up-script, nor switch is specified")
+		}
+		for _, script := range []string{pc.Up, pc.Down, pc.MTUChanged} {
+			if script == "" {
+				continue
+			}
+			if err = scriptCheck(script); err != nil {
+				issue(name, false, "%s", err)
+			}
+		}
+		conf, err := confParse(name, pc)
+		if err != nil {
+			issue(name, false, "%s", strings.TrimSuffix(err.Error(), ": "+name))
+			continue
+		}
+		if prev, exists := ids[*conf.Id]; exists {
+			issue(name, false, "same verifier as %s", prev)
+		} else {
+			ids[*conf.Id] = name
+		}
+
+		if err = shares.add(conf); err != nil {
+			issue(name, false, "%s", err)
+		}
+		if conf.Iface != "" && conf.Switch == "" {
+			if prev, exists := ifaces[conf.Iface]; exists {
+				issue(name, true, "iface %s is shared with %s", conf.Iface, prev)
+			} else {
+				ifaces[conf.Iface] = name
+			}
+		}
+		if pc.Encless && !pc.Noise {
+			issue(name, true, "encless forces noise")
+		}
+		if pc.CPR > 0 && !pc.Noise {
+			issue(name, true, "cpr forces noise")
+		}
+		if conf.CPR > 0 && conf.MTU < CheckCPRMTU {
+			issue(
+				name, true, "cpr with small MTU %d: %d packets per second",
+				conf.MTU, conf.CPR*1<<10/conf.MTU,
+			)
+		}
+		if pc.TimeoutInt < 0 {
+			issue(name, true, "negative timeout, default is used")
+		}
+		if conf.TimeSync > 0 && syncKnown && !synced {
+			issue(name, true, "timesync requires synchronized clocks, but local one is not synchronized by NTP")
+		}
+	}
+
+	sort.Stable(issues)
+	var errs int
+	for _, is := range issues {
+		checkPrint(w, is)
+		if !is.warning {
+			errs++
+		}
+	}
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
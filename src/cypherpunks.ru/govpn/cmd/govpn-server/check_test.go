@@ -0,0 +1,91 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestConfLines(t *testing.T) {
+	data := []byte(`# comment: not a peer
+alice:
+    iface: tap0
+"bob":
+  verifier: foo
+
+'carol': {iface: tap1}
+alice:
+dave
+`)
+	lines := confLines(data)
+	expected := map[string]int{"alice": 2, "bob": 4, "carol": 7}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatal("unexpected lines", lines)
+	}
+}
+
+func TestConfCheck(t *testing.T) {
+	confPathPrev := *confPath
+	defer func() { *confPath = confPathPrev }()
+	for _, c := range []struct {
+		path   string
+		code   int
+		output string
+	}{
+		{
+			"testdata/check-ok.yaml", 0,
+			"testdata/check-ok.yaml:6: warning: bob: iface tap0 is shared with alice\n",
+		},
+		{
+			"testdata/check-bad.yaml", 1,
+			"testdata/check-bad.yaml:7: error: bob: Script is not executable: testdata/noexec.sh\n" +
+				"testdata/check-bad.yaml:7: error: bob: IPv4 pool differs from alice's one on the same iface tap0\n" +
+				"testdata/check-bad.yaml:7: warning: bob: iface tap0 is shared with alice\n" +
+				"testdata/check-bad.yaml:12: error: carol: same verifier as alice\n" +
+				"testdata/check-bad.yaml:12: error: carol: Interface tap0 is own interface of alice\n" +
+				"testdata/check-bad.yaml:16: error: dave: stat testdata/absent.sh: no such file or directory\n" +
+				"testdata/check-bad.yaml:16: error: dave: Unable to decode verifier: Invalid verifier salt length\n" +
+				"testdata/check-bad.yaml:20: error: eve: neither iface, nor up-script, nor switch is specified\n" +
+				"testdata/check-bad.yaml:20: error: eve: same verifier as bob\n" +
+				"testdata/check-bad.yaml:20: warning: eve: encless forces noise\n" +
+				"testdata/check-bad.yaml:20: warning: eve: cpr forces noise\n" +
+				"testdata/check-bad.yaml:20: warning: eve: cpr with small MTU 1000: 65 packets per second\n" +
+				"testdata/check-bad.yaml:20: warning: eve: negative timeout, default is used\n",
+		},
+		{
+			"testdata/check-syntax.yaml", 1,
+			"testdata/check-syntax.yaml:3: error: yaml: did not find expected key\n",
+		},
+		{
+			"testdata/check-absent.yaml", 1,
+			"testdata/check-absent.yaml: error: open testdata/check-absent.yaml: no such file or directory\n",
+		},
+	} {
+		*confPath = c.path
+		var out bytes.Buffer
+		if code := confCheck(&out); code != c.code {
+			t.Fatal("unexpected exit code", c.path, code)
+		}
+		if out.String() != c.output {
+			t.Fatalf("unexpected output for %s:\n%s", c.path, out.String())
+		}
+	}
+}
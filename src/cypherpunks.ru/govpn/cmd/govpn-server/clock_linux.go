@@ -0,0 +1,22 @@
+// +build linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Ask kernel whether the clock is synchronized, for example by NTP.
+func clockSynced() (synced, known bool) {
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	if err != nil {
+		return false, false
+	}
+	return state != unix.TIME_ERROR && tx.Status&unix.STA_UNSYNC == 0, true
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package main
+
+// Clock synchronization status is unknown on that platform.
+func clockSynced() (synced, known bool) {
+	return false, false
+}
@@ -20,20 +20,46 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"sync"
+	"sync/atomic"
 
 	"cypherpunks.ru/govpn"
 )
 
+// Server-wide counters shown by stats.
+type Counters struct {
+	HandshakesHalfOpen  int64
+	HandshakesStarted   uint64
+	HandshakesCompleted uint64
+	HandshakesFailed    uint64
+	HandshakesLimited   uint64
+	IdentityUnknown     uint64
+	CookiesSent         uint64
+	CookiesAccepted     uint64
+	Roams               uint64
+	RoamsLimited        uint64
+	ConfReloads         uint64
+	ConfReloadsFailed   uint64
+}
+
 type PeerState struct {
 	peer       *govpn.Peer
 	terminator chan struct{}
 	tap        *govpn.TAP
+	// Switch the tap is the port of, nil for peer's own interface
+	sw *govpn.Switch
+	// Stream (TCP, WebSocket) connection, nil for UDP peers
+	conn io.Closer
 }
 
 var (
 	handshakes map[string]*govpn.Handshake = make(map[string]*govpn.Handshake)
+	hsPerPeer  map[govpn.PeerId]int        = make(map[govpn.PeerId]int)
 	hsLock     sync.RWMutex
+	cookies    *govpn.Cookies
+	roams      *roamLimiter
 
 	peers     map[string]*PeerState = make(map[string]*PeerState)
 	peersLock sync.RWMutex
@@ -43,14 +69,124 @@ var (
 
 	knownPeers govpn.KnownPeers
 	kpLock     sync.RWMutex
+
+	counters Counters
+
+	// Running down- and MTU changed scripts, waited for during the
+	// shutdown
+	scripts sync.WaitGroup
+
+	// Listeners, UDP sockets and stream connections, each served by
+	// its own goroutine. They are closed and waited for during the
+	// shutdown, together with UDP workers
+	transports     map[io.Closer]struct{} = make(map[io.Closer]struct{})
+	transportsLock sync.Mutex
+	running        sync.WaitGroup
+	// Set when the shutdown is started, guarded by transportsLock
+	stopping bool
 )
 
-func callUp(peerId *govpn.PeerId, remoteAddr string) (string, error) {
-	ifaceName := confs[*peerId].Iface
-	if confs[*peerId].Up != "" {
-		result, err := govpn.ScriptCall(confs[*peerId].Up, ifaceName, remoteAddr)
+// Remember half-open handshake. hsLock must be held.
+func hsAdd(addr string, hs *govpn.Handshake) {
+	handshakes[addr] = hs
+	hsPerPeer[*hs.Conf.Id]++
+	atomic.StoreInt64(&counters.HandshakesHalfOpen, int64(len(handshakes)))
+}
+
+// Forget half-open handshake. hsLock must be held.
+func hsDel(addr string) {
+	hs, exists := handshakes[addr]
+	if !exists {
+		return
+	}
+	delete(handshakes, addr)
+	if hsPerPeer[*hs.Conf.Id] <= 1 {
+		delete(hsPerPeer, *hs.Conf.Id)
+	} else {
+		hsPerPeer[*hs.Conf.Id]--
+	}
+	atomic.StoreInt64(&counters.HandshakesHalfOpen, int64(len(handshakes)))
+}
+
+// Forget the peer, release its interface and call down-script. Its
+// stream connection is closed and keys are zeroed, so no more packets
+// are accepted from it. peersLock, peersByIdLock and kpLock must be
+// held.
+func peerDelete(addr string, ps *PeerState) {
+	peerDeleteConf(addr, ps, confGet(*ps.peer.Id))
+}
+
+// Same as peerDelete, but the down-script is taken from the given
+// configuration: revoked peer is already absent in the current one.
+func peerDeleteConf(addr string, ps *PeerState, conf *govpn.PeerConf) {
+	if ps.conn != nil {
+		ps.conn.Close()
+	}
+	ps.peer.Zero()
+	delete(peers, addr)
+	delete(knownPeers, addr)
+	delete(peersById, *ps.peer.Id)
+	tapRelease(ps.peer.Id, ps.tap, ps.sw)
+	if conf != nil {
+		scripts.Add(1)
+		go func(path, ifaceName, addr string) {
+			govpn.ScriptCall(path, ifaceName, addr)
+			scripts.Done()
+		}(conf.Down, ps.tap.Name, ps.peer.Addr)
+	}
+	close(ps.terminator)
+}
+
+// Delete the peer at once when it says goodbye, if it is still the
+// registered one.
+func peerGoodbye(ps *PeerState) func(govpn.GoodbyeReason) {
+	return func(reason govpn.GoodbyeReason) {
+		peersLock.Lock()
+		peersByIdLock.Lock()
+		kpLock.Lock()
+		addr, exists := peersById[*ps.peer.Id]
+		if exists && peers[addr] == ps {
+			govpn.Printf(
+				`[peer-goodbye bind="%s" peer="%s" reason="%s"]`,
+				*bindAddr, ps.peer, reason,
+			)
+			peerDelete(addr, ps)
+		}
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+	}
+}
+
+// Disconnect the peer whose verifier is removed or changed. Its
+// previous configuration is used for the down-script.
+func peerRevoke(id govpn.PeerId, conf *govpn.PeerConf) {
+	peersLock.Lock()
+	peersByIdLock.Lock()
+	kpLock.Lock()
+	if addr, exists := peersById[id]; exists {
+		ps := peers[addr]
+		govpn.Printf(`[peer-revoke bind="%s" peer="%s"]`, *bindAddr, ps.peer)
+		ps.peer.Goodbye(govpn.GoodbyeRevoke)
+		peerDeleteConf(addr, ps, conf)
+	}
+	peersLock.Unlock()
+	peersByIdLock.Unlock()
+	kpLock.Unlock()
+}
+
+func callUp(peer *govpn.Peer) (string, error) {
+	peerId := peer.Id
+	conf := confGet(*peerId)
+	if conf == nil {
+		govpn.Printf(`[conf-get-failed bind="%s" peer="%s"]`, *bindAddr, peerId.String())
+		return "", errors.New("Unknown peer: " + peerId.String())
+	}
+	ifaceName := conf.Iface
+	if conf.Up != "" {
+		result, err := govpn.ScriptCallEnv(conf.Up, ifaceName, peer.Addr, peer.MTUEnv())
 		if err != nil {
-			govpn.Printf(`[script-failed bind="%s" path="%s" err="%s"]`, *bindAddr, confs[*peerId].Up, err)
+			govpn.Printf(`[script-failed bind="%s" path="%s" err="%s"]`, *bindAddr, conf.Up, err)
 			return "", err
 		}
 		if ifaceName == "" {
@@ -61,8 +197,56 @@ func callUp(peerId *govpn.PeerId, remoteAddr string) (string, error) {
 			ifaceName = string(result[:sepIndex])
 		}
 	}
-	if ifaceName == "" {
+	if ifaceName == "" && conf.Switch == "" {
 		govpn.Printf(`[tap-failed bind="%s" peer="%s"]`, *bindAddr, *peerId)
 	}
 	return ifaceName, nil
 }
+
+// Adjust interface's MTU when it differs from the configured one:
+// either because of smaller MTU negotiated in the handshake, or because
+// of path MTU discovery. Switch ports have no interface of their own.
+// Up-script already knows negotiated MTU, so optional MTU changed
+// script is called only after the discovery, that happens later.
+func mtuStart(peer *govpn.Peer, tap *govpn.TAP) {
+	conf := confGet(*peer.Id)
+	if conf == nil || conf.Switch != "" {
+		return
+	}
+	mtuSet := func(int) bool {
+		if err := tap.MTUSet(peer.IfaceMTU()); err != nil {
+			govpn.Printf(
+				`[mtu-failed bind="%s" peer="%s" iface="%s" err="%s"]`,
+				*bindAddr, peer.Id.String(), tap.Name, err,
+			)
+			return false
+		}
+		govpn.Printf(
+			`[mtu-changed bind="%s" peer="%s" iface="%s" mtu="%d"]`,
+			*bindAddr, peer.Id.String(), tap.Name, peer.IfaceMTU(),
+		)
+		return true
+	}
+	if peer.MTU != conf.MTU {
+		mtuSet(peer.MTU)
+	}
+	peer.MTUHandler = func(mtu int) {
+		if !mtuSet(mtu) {
+			return
+		}
+		conf := confGet(*peer.Id)
+		if conf == nil || conf.MTUChanged == "" {
+			return
+		}
+		scripts.Add(1)
+		go func(path, ifaceName, addr string, env []string) {
+			if _, err := govpn.ScriptCallEnv(path, ifaceName, addr, env); err != nil {
+				govpn.Printf(
+					`[script-failed bind="%s" path="%s" err="%s"]`,
+					*bindAddr, path, err,
+				)
+			}
+			scripts.Done()
+		}(conf.MTUChanged, tap.Name, peer.Addr, peer.MTUEnv())
+	}
+}
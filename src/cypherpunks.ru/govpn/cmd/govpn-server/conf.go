@@ -22,6 +22,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-yaml/yaml"
@@ -34,10 +38,20 @@ const (
 )
 
 var (
-	confs    map[govpn.PeerId]*govpn.PeerConf
-	idsCache *govpn.MACCache
+	confs       map[govpn.PeerId]*govpn.PeerConf
+	confsLock   sync.RWMutex
+	refreshLock sync.Mutex
+	idsCache    *govpn.MACCache
 )
 
+// Get peer's current configuration, nil if there is no such peer.
+func confGet(id govpn.PeerId) *govpn.PeerConf {
+	confsLock.RLock()
+	conf := confs[id]
+	confsLock.RUnlock()
+	return conf
+}
+
 func confRead() (*map[govpn.PeerId]*govpn.PeerConf, error) {
 	data, err := ioutil.ReadFile(*confPath)
 	if err != nil {
@@ -50,62 +64,292 @@ func confRead() (*map[govpn.PeerId]*govpn.PeerConf, error) {
 	}
 
 	confs := make(map[govpn.PeerId]*govpn.PeerConf, len(*confsRaw))
+	shares := newConfShares()
 	for name, pc := range *confsRaw {
-		verifier, err := govpn.VerifierFromString(pc.VerifierRaw)
+		conf, err := confParse(name, pc)
 		if err != nil {
-			return nil, errors.New("Unable to decode verifier: " + err.Error())
+			return nil, err
 		}
-		if pc.Encless {
-			pc.Noise = true
+		if err = shares.add(conf); err != nil {
+			return nil, errors.New(err.Error() + ": " + name)
 		}
-		if pc.MTU == 0 {
-			pc.MTU = govpn.MTUDefault
+		if dup, exists := confs[*conf.Id]; exists {
+			return nil, errors.New("Duplicate peer identity: " + name + " and " + dup.Name)
 		}
-		if pc.MTU > govpn.MTUMax {
-			govpn.Printf(`[mtu-high bind="%s" value="%d" overriden="%d"]`, *bindAddr, pc.MTU, govpn.MTUMax)
-			pc.MTU = govpn.MTUMax
+		confs[*conf.Id] = conf
+	}
+	return &confs, nil
+}
+
+// Interfaces and switches shared by the peers. The same interface can
+// not be both switch's uplink and peer's own one. Addresses pools
+// belong to the interface or switch, so they must be the same for all
+// its peers.
+type confShares struct {
+	uplinks map[string]string
+	ifaces  map[string]string
+	pools4  map[string]*govpn.PeerConf
+	pools6  map[string]*govpn.PeerConf
+}
+
+func newConfShares() *confShares {
+	return &confShares{
+		uplinks: make(map[string]string),
+		ifaces:  make(map[string]string),
+		pools4:  make(map[string]*govpn.PeerConf),
+		pools6:  make(map[string]*govpn.PeerConf),
+	}
+}
+
+// Remember peer's interface, switch and pools, checking them against
+// already added peers.
+func (cs *confShares) add(conf *govpn.PeerConf) error {
+	if conf.Iface != "" {
+		mine, others := cs.ifaces, cs.uplinks
+		if conf.Switch != "" {
+			mine, others = cs.uplinks, cs.ifaces
 		}
-		conf := govpn.PeerConf{
-			Verifier: verifier,
-			Id:       verifier.Id,
-			Name:     name,
-			Iface:    pc.Iface,
-			MTU:      pc.MTU,
-			Up:       pc.Up,
-			Down:     pc.Down,
-			Noise:    pc.Noise,
-			CPR:      pc.CPR,
-			Encless:  pc.Encless,
-			TimeSync: pc.TimeSync,
+		if name, exists := others[conf.Iface]; exists {
+			if conf.Switch == "" {
+				return errors.New("Interface " + conf.Iface + " is switch uplink of " + name)
+			}
+			return errors.New("Interface " + conf.Iface + " is own interface of " + name)
 		}
-		if pc.TimeoutInt <= 0 {
-			pc.TimeoutInt = govpn.TimeoutDefault
+		if _, exists := mine[conf.Iface]; !exists {
+			mine[conf.Iface] = conf.Name
 		}
-		conf.Timeout = time.Second * time.Duration(pc.TimeoutInt)
-		confs[*verifier.Id] = &conf
 	}
-	return &confs, nil
+	// Interface's name given by up-script is known only at runtime
+	key := "iface " + conf.Iface
+	if conf.Switch != "" {
+		key = "switch " + conf.Switch
+	} else if conf.Iface == "" {
+		return nil
+	}
+	if conf.Pool4 != nil {
+		if prev, exists := cs.pools4[key]; !exists {
+			cs.pools4[key] = conf
+		} else if prev.Pool4.String() != conf.Pool4.String() {
+			return errors.New("IPv4 pool differs from " + prev.Name + "'s one on the same " + key)
+		}
+	}
+	if conf.Pool6 != nil {
+		if prev, exists := cs.pools6[key]; !exists {
+			cs.pools6[key] = conf
+		} else if prev.Pool6.String() != conf.Pool6.String() {
+			return errors.New("IPv6 pool differs from " + prev.Name + "'s one on the same " + key)
+		}
+	}
+	return nil
 }
 
+// Parse and validate single peer's configuration entry.
+func confParse(name string, pc govpn.PeerConf) (*govpn.PeerConf, error) {
+	verifier, err := govpn.VerifierFromString(pc.VerifierRaw)
+	if err != nil {
+		return nil, errors.New("Unable to decode verifier: " + err.Error())
+	}
+	if err = verifier.PubValidate(); err != nil {
+		return nil, errors.New(err.Error() + ": " + name)
+	}
+	mode, err := govpn.ModeFromString(pc.ModeRaw)
+	if err != nil {
+		return nil, err
+	}
+	if pc.Switch != "" && mode != govpn.ModeTAP {
+		return nil, errors.New("Switch can be used only in TAP mode: " + name)
+	}
+	suites := make([]govpn.Suite, 0, len(pc.SuitesRaw))
+	for _, suiteRaw := range pc.SuitesRaw {
+		suite, err := govpn.SuiteFromString(suiteRaw)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	var pool4, pool6 *net.IPNet
+	if pc.Pool4Raw != "" {
+		if _, pool4, err = net.ParseCIDR(pc.Pool4Raw); err != nil || pool4.IP.To4() == nil {
+			return nil, errors.New("Invalid IPv4 pool: " + name)
+		}
+	}
+	if pc.Pool6Raw != "" {
+		if _, pool6, err = net.ParseCIDR(pc.Pool6Raw); err != nil || pool6.IP.To4() != nil {
+			return nil, errors.New("Invalid IPv6 pool: " + name)
+		}
+	}
+	routes := make([]*net.IPNet, 0, len(pc.RoutesRaw))
+	for _, routeRaw := range pc.RoutesRaw {
+		_, route, err := net.ParseCIDR(routeRaw)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	dnses := make([]net.IP, 0, len(pc.DNSRaw))
+	for _, dnsRaw := range pc.DNSRaw {
+		dns := net.ParseIP(dnsRaw)
+		if dns == nil {
+			return nil, errors.New("Invalid DNS server address: " + name)
+		}
+		dnses = append(dnses, dns)
+	}
+	if pc.Encless {
+		pc.Noise = true
+	}
+	if pc.MTU == 0 {
+		pc.MTU = govpn.MTUDefaultFor(mode)
+	}
+	if pc.MTU < govpn.MTUMin || pc.MTU > govpn.MTUMax {
+		return nil, errors.New("Invalid MTU: " + name)
+	}
+	if pc.Hybrid && pc.Noise && pc.MTU < govpn.KEMMTUMin {
+		return nil, errors.New("MTU is too small for noised hybrid handshake: " + name)
+	}
+	if pc.CPR < 0 {
+		return nil, errors.New("Negative CPR: " + name)
+	}
+	// At least one packet per second must be sent
+	pktSize := pc.MTU
+	if pc.Encless {
+		pktSize += govpn.EnclessEnlargeSize
+	}
+	if pc.CPR > 0 && pc.CPR*1<<10 < pktSize {
+		return nil, errors.New("CPR is too small for MTU: " + name)
+	}
+	conf := govpn.PeerConf{
+		Verifier:   verifier,
+		Id:         verifier.Id,
+		Name:       name,
+		Iface:      pc.Iface,
+		MTU:        pc.MTU,
+		Mode:       mode,
+		Up:         pc.Up,
+		Down:       pc.Down,
+		MTUChanged: pc.MTUChanged,
+		Noise:      pc.Noise,
+		CPR:        pc.CPR,
+		Encless:    pc.Encless,
+		Hybrid:     pc.Hybrid,
+		Suites:     suites,
+		Switch:     pc.Switch,
+		TimeSync:   pc.TimeSync,
+		Pool4:      pool4,
+		Pool6:      pool6,
+		Routes:     routes,
+		DNS:        dnses,
+	}
+	if pc.TimeoutInt <= 0 {
+		pc.TimeoutInt = govpn.TimeoutDefault
+	}
+	conf.Timeout = time.Second * time.Duration(pc.TimeoutInt)
+	if pc.RekeyInt < 0 {
+		return nil, errors.New("Negative rekey interval: " + name)
+	}
+	conf.Rekey = time.Second * time.Duration(pc.RekeyInt)
+	if pc.ReplayWindow < 0 {
+		return nil, errors.New("Negative replay window: " + name)
+	}
+	if pc.ReplayWindow == 0 {
+		pc.ReplayWindow = govpn.ReplayWindowDefault
+	}
+	conf.ReplayWindow = pc.ReplayWindow
+	return &conf, nil
+}
+
+// Log peers added, removed and changed by the new configuration.
+// Identities of removed peers and of peers with changed verifier are
+// returned: they must be disconnected.
+func confDiff(prev, next map[govpn.PeerId]*govpn.PeerConf) []govpn.PeerId {
+	var revoked []govpn.PeerId
+	for id, conf := range prev {
+		if _, exists := next[id]; !exists {
+			govpn.Printf(
+				`[conf-peer-removed bind="%s" peer="%s" name="%s"]`,
+				*bindAddr, id.String(), conf.Name,
+			)
+			revoked = append(revoked, id)
+		}
+	}
+	for id, conf := range next {
+		confPrev, exists := prev[id]
+		if !exists {
+			govpn.Printf(
+				`[conf-peer-added bind="%s" peer="%s" name="%s"]`,
+				*bindAddr, id.String(), conf.Name,
+			)
+			continue
+		}
+		if reflect.DeepEqual(confPrev, conf) {
+			continue
+		}
+		govpn.Printf(
+			`[conf-peer-changed bind="%s" peer="%s" name="%s"]`,
+			*bindAddr, id.String(), conf.Name,
+		)
+		if confPrev.Verifier.LongForm() != conf.Verifier.LongForm() {
+			revoked = append(revoked, id)
+		}
+	}
+	return revoked
+}
+
+// Reread configuration and replace the current one, if it is valid.
+// New configuration is put in place before peers with removed or
+// changed verifiers are disconnected, so they can not complete the
+// handshake with the old one meanwhile.
 func confRefresh() error {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
 	newConfs, err := confRead()
 	if err != nil {
 		govpn.Printf(`[conf-parse-failed bind="%s" err="%s"]`, *bindAddr, err)
+		atomic.AddUint64(&counters.ConfReloadsFailed, 1)
 		return err
 	}
+	confsLock.Lock()
+	prev := confs
 	confs = *newConfs
+	confsLock.Unlock()
 	idsCache.Update(newConfs)
+	var revoked []govpn.PeerId
+	if prev != nil {
+		revoked = confDiff(prev, *newConfs)
+	}
+	hsLock.Lock()
+	for _, id := range revoked {
+		for addr, hs := range handshakes {
+			if *hs.Conf.Id == id {
+				hs.Zero()
+				hsDel(addr)
+			}
+		}
+	}
+	hsLock.Unlock()
+	for _, id := range revoked {
+		peerRevoke(id, prev[id])
+	}
+	atomic.AddUint64(&counters.ConfReloads, 1)
 	return nil
 }
 
+// Read initial configuration and refresh it when the file is changed.
+// If the file can not be watched, then it is polled periodically.
 func confInit() {
 	idsCache = govpn.NewMACCache()
 	if err := confRefresh(); err != nil {
 		log.Fatalln(err)
 	}
+	changes, err := confWatch(*confPath)
+	if err != nil {
+		govpn.Printf(`[conf-watch-failed bind="%s" err="%s"]`, *bindAddr, err)
+	}
 	go func() {
 		for {
-			time.Sleep(RefreshRate)
+			select {
+			case <-changes:
+			case <-time.After(RefreshRate):
+			}
 			confRefresh()
 		}
 	}()
@@ -0,0 +1,247 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+type testConn struct {
+	closed bool
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// Peer removed from the configuration is disconnected at once: it is
+// said goodbye, its connection is closed and its packets are rejected.
+func TestConfRevoke(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPathPrev := *confPath
+	*confPath = path.Join(dir, "peers.yaml")
+	defer func() {
+		*confPath = confPathPrev
+		confs = nil
+	}()
+	id := new(govpn.PeerId)
+	if _, err = io.ReadFull(govpn.Rand, id[:]); err != nil {
+		t.Fatal(err)
+	}
+	v := govpn.VerifierNew(1<<10, 1<<4, 1, id)
+	dsaPriv := v.PasswordApply("does not matter")
+	down := path.Join(dir, "down.sh")
+	if err = ioutil.WriteFile(down, []byte("#!/bin/sh\ntouch "+down+".done\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf := []byte(
+		"alice: {switch: revoke, down: " + down +
+			", verifier: \"" + v.LongForm() + "\"}\n",
+	)
+	if err = ioutil.WriteFile(*confPath, conf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	idsCache = govpn.NewMACCache()
+	if err = confRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	if knownPeers == nil {
+		knownPeers = govpn.KnownPeers(make(map[string]**govpn.Peer))
+	}
+
+	confC := *confGet(*id)
+	confC.DSAPriv = dsaPriv
+	addr := "192.0.2.1:1194"
+	peerC, peerS, wire := benchHandshake(t, &confC, addr)
+	tap, sw, err := tapListen(peerS, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := new(testConn)
+	ps := &PeerState{
+		peer:       peerS,
+		tap:        tap,
+		sw:         sw,
+		terminator: make(chan struct{}),
+		conn:       conn,
+	}
+	peersLock.Lock()
+	peersByIdLock.Lock()
+	kpLock.Lock()
+	peers[addr] = ps
+	peersById[*id] = addr
+	knownPeers[addr] = &peerS
+	peersLock.Unlock()
+	peersByIdLock.Unlock()
+	kpLock.Unlock()
+
+	frame := make([]byte, govpn.EtherSize)
+	peerC.EthProcess(frame)
+	if !peerS.PktProcess(wire.buf, tap, true) {
+		t.Fatal("rejected before revocation")
+	}
+	peerC.EthProcess(frame)
+	pkt := append([]byte{}, wire.buf...)
+
+	if err = ioutil.WriteFile(*confPath, []byte("{}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = confRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	if peerS.PktProcess(pkt, tap, true) {
+		t.Fatal("accepted after revocation")
+	}
+	if !conn.closed {
+		t.Fatal("connection is not closed")
+	}
+	peersLock.RLock()
+	_, exists := peers[addr]
+	peersLock.RUnlock()
+	if exists {
+		t.Fatal("peer is not deleted")
+	}
+	switchesLock.Lock()
+	_, exists = switches["revoke"]
+	switchesLock.Unlock()
+	if exists {
+		t.Fatal("switch without ports is not deleted")
+	}
+	var reason govpn.GoodbyeReason
+	peerC.GoodbyeHandler = func(r govpn.GoodbyeReason) { reason = r }
+	peerC.PktProcess(peerS.Conn.(*benchWire).buf, ioutil.Discard, true)
+	if reason != govpn.GoodbyeRevoke {
+		t.Fatal("goodbye is not received", reason)
+	}
+	if !waitUntil(&scripts, time.Now().Add(time.Second)) {
+		t.Fatal("down-script is not finished")
+	}
+	if _, err = os.Stat(down + ".done"); err != nil {
+		t.Fatal("down-script of revoked peer is not called")
+	}
+}
+
+// Switch port is released even if the peer is not switched anymore
+// after the configuration reload.
+func TestTapReleaseSwitchChanged(t *testing.T) {
+	id := new(govpn.PeerId)
+	id[0] = 1
+	confsLock.Lock()
+	confs = map[govpn.PeerId]*govpn.PeerConf{*id: {Id: id, Switch: "changed"}}
+	confsLock.Unlock()
+	defer func() { confs = nil }()
+	peer := &govpn.Peer{Id: id, MTU: govpn.MTUDefault, Mode: govpn.ModeTAP}
+	tap, sw, err := tapListen(peer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sw == nil || sw.PortsNum() != 1 {
+		t.Fatal("port is not added")
+	}
+	confsLock.Lock()
+	confs[*id] = &govpn.PeerConf{Id: id, Iface: "tap0"}
+	confsLock.Unlock()
+	tapRelease(id, tap, sw)
+	switchesLock.Lock()
+	_, exists := switches["changed"]
+	switchesLock.Unlock()
+	if exists || sw.PortsNum() != 0 {
+		t.Fatal("port is not released")
+	}
+}
+
+func TestTapListenUplinkConflict(t *testing.T) {
+	id := new(govpn.PeerId)
+	id[0] = 2
+	confsLock.Lock()
+	confs = map[govpn.PeerId]*govpn.PeerConf{*id: {Id: id, Iface: "uplink0"}}
+	confsLock.Unlock()
+	defer func() { confs = nil }()
+	switchesLock.Lock()
+	uplinks["uplink0"] = "office"
+	switchesLock.Unlock()
+	defer func() {
+		switchesLock.Lock()
+		delete(uplinks, "uplink0")
+		switchesLock.Unlock()
+	}()
+	peer := &govpn.Peer{Id: id, MTU: govpn.MTUDefault, Mode: govpn.ModeTAP}
+	if _, _, err := tapListen(peer, "uplink0"); err == nil {
+		t.Fatal("switch uplink is used as peer's own interface")
+	}
+}
+
+func TestConfSharesIface(t *testing.T) {
+	shares := newConfShares()
+	if err := shares.add(&govpn.PeerConf{Name: "alice", Iface: "tap0", Switch: "office"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.add(&govpn.PeerConf{Name: "bob", Iface: "tap0", Switch: "office"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.add(&govpn.PeerConf{Name: "carol", Iface: "tap0"}); err == nil {
+		t.Fatal("uplink is used as own interface")
+	}
+	if err := shares.add(&govpn.PeerConf{Name: "dave", Iface: "tap1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shares.add(&govpn.PeerConf{Name: "eve", Iface: "tap1", Switch: "home"}); err == nil {
+		t.Fatal("own interface is used as uplink")
+	}
+}
+
+func TestConfSharesPools(t *testing.T) {
+	_, net8, _ := net.ParseCIDR("10.8.0.0/24")
+	_, net9, _ := net.ParseCIDR("10.9.0.0/24")
+	_, net6, _ := net.ParseCIDR("fd00::/64")
+	_, net7, _ := net.ParseCIDR("fd01::/64")
+	shares := newConfShares()
+	for _, c := range []struct {
+		conf  govpn.PeerConf
+		valid bool
+	}{
+		{govpn.PeerConf{Name: "alice", Iface: "tap0", Pool4: net8, Pool6: net6}, true},
+		{govpn.PeerConf{Name: "bob", Iface: "tap0", Pool4: net8}, true},
+		{govpn.PeerConf{Name: "carol", Iface: "tap0", Pool4: net9}, false},
+		{govpn.PeerConf{Name: "dave", Iface: "tap0", Pool6: net7}, false},
+		{govpn.PeerConf{Name: "eve", Iface: "tap1", Pool4: net9}, true},
+		{govpn.PeerConf{Name: "frank", Switch: "office", Pool4: net9}, true},
+		{govpn.PeerConf{Name: "grace", Switch: "office", Iface: "tap2", Pool4: net8}, false},
+		{govpn.PeerConf{Name: "heidi", Up: "./up.sh", Pool4: net8}, true},
+		{govpn.PeerConf{Name: "ivan", Up: "./up.sh", Pool4: net9}, true},
+	} {
+		conf := c.conf
+		if err := shares.add(&conf); (err == nil) != c.valid {
+			t.Fatal("unexpected pools check result", conf.Name, err)
+		}
+	}
+}
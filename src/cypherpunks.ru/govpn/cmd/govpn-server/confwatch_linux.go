@@ -0,0 +1,68 @@
+// +build linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watch configuration file's directory with inotify, because editors
+// often replace the file by renaming the new one. Channel receives
+// value when the file is written or replaced. Several changes in a row
+// are coalesced.
+func confWatch(path string) (chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	_, err = unix.InotifyAddWatch(
+		fd,
+		filepath.Dir(path),
+		unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE,
+	)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	name := []byte(filepath.Base(path))
+	changes := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 1<<12)
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				return
+			}
+			var changed bool
+			for i := 0; i+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[i]))
+				i += unix.SizeofInotifyEvent
+				evName := bytes.TrimRight(buf[i:i+int(ev.Len)], "\x00")
+				i += int(ev.Len)
+				if bytes.Equal(evName, name) {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+// Configuration file is only polled on that platform.
+func confWatch(path string) (chan struct{}, error) {
+	return nil, errors.New("Watching is not supported")
+}
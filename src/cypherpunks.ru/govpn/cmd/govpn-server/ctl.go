@@ -0,0 +1,116 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+type ctlPeer struct {
+	Name string
+	*govpn.Peer
+}
+
+type ctlHandshake struct {
+	Addr     string
+	Name     string
+	LastPing time.Time
+}
+
+func peerName(id *govpn.PeerId) string {
+	if conf := confGet(*id); conf != nil {
+		return conf.Name
+	}
+	return ""
+}
+
+// Find connected peer either by its name or identity.
+// peersLock must be held.
+func peerFind(nameOrId string) (string, *PeerState) {
+	for addr, ps := range peers {
+		if ps.peer.Id.String() == nameOrId || peerName(ps.peer.Id) == nameOrId {
+			return addr, ps
+		}
+	}
+	return "", nil
+}
+
+func ctlHandle(cmd, arg string) (interface{}, error) {
+	switch cmd {
+	case "peers":
+		peersLock.RLock()
+		list := make([]ctlPeer, 0, len(peers))
+		for _, ps := range peers {
+			list = append(list, ctlPeer{peerName(ps.peer.Id), ps.peer})
+		}
+		peersLock.RUnlock()
+		return list, nil
+	case "handshakes":
+		hsLock.RLock()
+		list := make([]ctlHandshake, 0, len(handshakes))
+		for addr, hs := range handshakes {
+			list = append(list, ctlHandshake{addr, hs.Conf.Name, hs.LastPing})
+		}
+		hsLock.RUnlock()
+		return list, nil
+	case "stats":
+		peersLock.RLock()
+		_, ps := peerFind(arg)
+		peersLock.RUnlock()
+		if ps == nil {
+			return nil, errors.New("Unknown peer: " + arg)
+		}
+		return ctlPeer{peerName(ps.peer.Id), ps.peer}, nil
+	case "counters":
+		return &counters, nil
+	case "kick":
+		peersLock.Lock()
+		peersByIdLock.Lock()
+		kpLock.Lock()
+		addr, ps := peerFind(arg)
+		if ps != nil {
+			govpn.Printf(`[peer-kick bind="%s" peer="%s"]`, *bindAddr, ps.peer)
+			ps.peer.Goodbye(govpn.GoodbyeKick)
+			peerDelete(addr, ps)
+		}
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+		if ps == nil {
+			return nil, errors.New("Unknown peer: " + arg)
+		}
+		return nil, nil
+	case "rekey":
+		peersLock.RLock()
+		_, ps := peerFind(arg)
+		peersLock.RUnlock()
+		if ps == nil {
+			return nil, errors.New("Unknown peer: " + arg)
+		}
+		govpn.Printf(`[rekey-forced bind="%s" peer="%s"]`, *bindAddr, ps.peer)
+		ps.peer.RekeyForce()
+		return nil, nil
+	case "reload":
+		return nil, confRefresh()
+	}
+	return nil, errors.New("Unknown command: " + cmd)
+}
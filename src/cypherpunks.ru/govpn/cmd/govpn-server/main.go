@@ -26,6 +26,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cypherpunks.ru/govpn"
@@ -37,8 +40,18 @@ var (
 	confPath = flag.String("conf", "peers.yaml", "Path to configuration YAML")
 	stats    = flag.String("stats", "", "Enable stats retrieving on host:port")
 	proxy    = flag.String("proxy", "", "Enable HTTP proxy on host:port")
+	workers  = flag.Int("udp-workers", runtime.NumCPU(), "Number of UDP packets processing workers")
+	reuse    = flag.Bool("reuseport", false, "Listen on UDP socket per worker with SO_REUSEPORT")
+	wsAddr   = flag.String("ws", "", "Enable WebSocket transport on host:port")
+	wsPath   = flag.String("ws-path", "/", "WebSocket upgrade requests path")
 	egdPath  = flag.String("egd", "", "Optional path to EGD socket")
+	hsMax    = flag.Int("hs-max", 1<<10, "Maximal number of half-open handshakes")
+	hsPeer   = flag.Int("hs-peer-max", 1<<4, "Maximal number of half-open handshakes per peer")
+	cookieHs = flag.Int("cookie-hs", 1<<6, "Half-open handshakes number to require cookies after")
+	roamMax  = flag.Int("roam-max", 1<<6, "Maximal number of UDP roaming attempts per second")
+	ctlPath  = flag.String("ctl", "", "Enable control Unix domain socket on that path")
 	syslog   = flag.Bool("syslog", false, "Enable logging to syslog")
+	check    = flag.Bool("check", false, "Check configuration file and exit")
 	warranty = flag.Bool("warranty", false, "Print warranty information")
 )
 
@@ -48,11 +61,16 @@ func main() {
 		fmt.Println(govpn.Warranty)
 		return
 	}
+	if *check {
+		os.Exit(confCheck(os.Stderr))
+	}
 	timeout := time.Second * time.Duration(govpn.TimeoutDefault)
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 	log.Println(govpn.VersionGet())
 
 	confInit()
+	cookies = govpn.NewCookies()
+	roams = newRoamLimiter(*roamMax)
 	knownPeers = govpn.KnownPeers(make(map[string]**govpn.Peer))
 
 	if *egdPath != "" {
@@ -77,7 +95,9 @@ func main() {
 	}
 
 	termSignal := make(chan os.Signal, 1)
-	signal.Notify(termSignal, os.Interrupt, os.Kill)
+	signal.Notify(termSignal, os.Interrupt, syscall.SIGTERM)
+	hupSignal := make(chan os.Signal, 1)
+	signal.Notify(hupSignal, syscall.SIGHUP)
 
 	hsHeartbeat := time.Tick(timeout)
 	go func() { <-hsHeartbeat }()
@@ -88,27 +108,43 @@ func main() {
 		if err != nil {
 			log.Fatalln("Can not listen on stats port:", err)
 		}
-		go govpn.StatsProcessor(statsPort, &knownPeers)
+		go govpn.StatsProcessor(statsPort, &knownPeers, &counters)
 	}
 	if *proxy != "" {
 		go proxyStart()
 	}
+	if *wsAddr != "" {
+		go wsStart()
+	}
+	if *ctlPath != "" {
+		log.Println("Control socket is going to listen on", *ctlPath)
+		ctl, err := govpn.CtlListen(*ctlPath)
+		if err != nil {
+			log.Fatalln("Can not listen on control socket:", err)
+		}
+		go govpn.CtlProcessor(ctl, ctlHandle)
+	}
 	govpn.BothPrintf(`[started bind="%s"]`, *bindAddr)
 
+	serve(termSignal, hupSignal, hsHeartbeat, timeout)
+}
+
+// Serve until the termination signal, then shut down gracefully.
+// Configuration is reread on SIGHUP, timeouted handshakes and peers are
+// deleted on each heartbeat.
+func serve(termSignal, hupSignal <-chan os.Signal, hsHeartbeat <-chan time.Time, timeout time.Duration) {
 	var needsDeletion bool
 MainCycle:
 	for {
 		select {
 		case <-termSignal:
 			govpn.BothPrintf(`[terminating bind="%s"]`, *bindAddr)
-			for _, ps := range peers {
-				govpn.ScriptCall(
-					confs[*ps.peer.Id].Down,
-					ps.tap.Name,
-					ps.peer.Addr,
-				)
-			}
+			shutdown()
 			break MainCycle
+		case <-hupSignal:
+			if confRefresh() == nil {
+				govpn.Printf(`[conf-refreshed bind="%s"]`, *bindAddr)
+			}
 		case <-hsHeartbeat:
 			now := time.Now()
 			hsLock.Lock()
@@ -116,7 +152,8 @@ MainCycle:
 				if hs.LastPing.Add(timeout).Before(now) {
 					govpn.Printf(`[handshake-delete bind="%s" addr="%s"]`, *bindAddr, addr)
 					hs.Zero()
-					delete(handshakes, addr)
+					hsDel(addr)
+					atomic.AddUint64(&counters.HandshakesFailed, 1)
 				}
 			}
 			peersLock.Lock()
@@ -128,21 +165,14 @@ MainCycle:
 				ps.peer.BusyR.Unlock()
 				if needsDeletion {
 					govpn.Printf(`[peer-delete bind="%s" peer="%s"]`, *bindAddr, ps.peer)
-					delete(peers, addr)
-					delete(knownPeers, addr)
-					delete(peersById, *ps.peer.Id)
-					go govpn.ScriptCall(
-						confs[*ps.peer.Id].Down,
-						ps.tap.Name,
-						ps.peer.Addr,
-					)
-					ps.terminator <- struct{}{}
+					peerDelete(addr, ps)
 				}
 			}
 			hsLock.Unlock()
 			peersLock.Unlock()
 			peersByIdLock.Unlock()
 			kpLock.Unlock()
+			switchesAge(now)
 		}
 	}
 }
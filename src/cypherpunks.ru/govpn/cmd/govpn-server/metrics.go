@@ -0,0 +1,75 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"sync/atomic"
+
+	"cypherpunks.ru/govpn"
+)
+
+// Write server-wide counters and active peers number per protocol in
+// Prometheus format.
+func (c *Counters) MetricsWrite(w io.Writer) {
+	govpn.MetricWrite(
+		w, "govpn_handshakes_half_open", "gauge",
+		"Half-open handshakes number",
+		atomic.LoadInt64(&c.HandshakesHalfOpen),
+	)
+	for _, m := range []struct {
+		name  string
+		help  string
+		value *uint64
+	}{
+		{"handshakes_started", "Handshakes started", &c.HandshakesStarted},
+		{"handshakes_completed", "Handshakes completed", &c.HandshakesCompleted},
+		{"handshakes_failed", "Handshakes failed or timed out", &c.HandshakesFailed},
+		{"handshakes_limited", "Handshakes ignored because of limits", &c.HandshakesLimited},
+		{"identity_unknown", "Packets with unknown identity", &c.IdentityUnknown},
+		{"cookies_sent", "Handshake cookies sent", &c.CookiesSent},
+		{"cookies_accepted", "Handshake cookies accepted", &c.CookiesAccepted},
+		{"roams", "UDP peers moved to another address", &c.Roams},
+		{"roams_limited", "Roaming attempts ignored because of limits", &c.RoamsLimited},
+		{"conf_reloads", "Successful configuration reloads", &c.ConfReloads},
+		{"conf_reloads_failed", "Failed configuration reloads", &c.ConfReloadsFailed},
+	} {
+		govpn.MetricWrite(
+			w, "govpn_"+m.name+"_total", "counter",
+			m.help, atomic.LoadUint64(m.value),
+		)
+	}
+	var udp, tcp, ws int
+	peersLock.RLock()
+	for _, ps := range peers {
+		switch ps.peer.Conn.(type) {
+		case *UDPSender:
+			udp++
+		case *govpn.WSConn:
+			ws++
+		default:
+			tcp++
+		}
+	}
+	peersLock.RUnlock()
+	govpn.MetricHeader(w, "govpn_peers", "gauge", "Active peers number")
+	govpn.MetricSample(w, "govpn_peers", govpn.MetricLabels("proto", "udp"), udp)
+	govpn.MetricSample(w, "govpn_peers", govpn.MetricLabels("proto", "tcp"), tcp)
+	govpn.MetricSample(w, "govpn_peers", govpn.MetricLabels("proto", "ws"), ws)
+}
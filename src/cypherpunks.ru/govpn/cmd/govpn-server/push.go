@@ -0,0 +1,92 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"sync"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	pools     map[string]*govpn.IPPool = make(map[string]*govpn.IPPool)
+	poolsLock sync.Mutex
+)
+
+// Get the pool shared by all peers of the same interface or switch.
+// It is recreated if configuration has changed.
+func poolGet(key string, network *net.IPNet) (*govpn.IPPool, error) {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	pool, exists := pools[key]
+	if exists && pool.Equal(network) {
+		return pool, nil
+	}
+	pool, err := govpn.NewIPPool(network)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		govpn.Printf(`[pool-changed bind="%s" pool="%s" network="%s"]`, *bindAddr, key, network)
+	}
+	pools[key] = pool
+	return pool, nil
+}
+
+// Start pushing network configuration to the peer, if there is any.
+func pushStart(peer *govpn.Peer, tap *govpn.TAP) {
+	conf := confGet(*peer.Id)
+	if conf == nil {
+		return
+	}
+	if conf.Pool4 == nil && conf.Pool6 == nil && len(conf.Routes) == 0 && len(conf.DNS) == 0 {
+		return
+	}
+	key := "iface:" + tap.Name
+	if conf.Switch != "" {
+		key = "switch:" + conf.Switch
+	}
+	pc := govpn.PushConf{Routes: conf.Routes, DNS: conf.DNS}
+	var pool *govpn.IPPool
+	var err error
+	if conf.Pool4 != nil {
+		if pool, err = poolGet(key+":4", conf.Pool4); err == nil {
+			pc.Gateway4 = pool.Gateway()
+			pc.Addr4, err = pool.Lease(peer.Id)
+		}
+	}
+	if err == nil && conf.Pool6 != nil {
+		if pool, err = poolGet(key+":6", conf.Pool6); err == nil {
+			pc.Gateway6 = pool.Gateway()
+			pc.Addr6, err = pool.Lease(peer.Id)
+		}
+	}
+	if err == nil {
+		err = peer.PushSet(&pc)
+	}
+	if err != nil {
+		govpn.Printf(`[push-failed bind="%s" peer="%s" err="%s"]`, *bindAddr, peer.Id.String(), err)
+		return
+	}
+	govpn.Printf(
+		`[push-started bind="%s" peer="%s" addr4="%s" addr6="%s"]`,
+		*bindAddr, peer.Id.String(), pc.Addr4, pc.Addr6,
+	)
+}
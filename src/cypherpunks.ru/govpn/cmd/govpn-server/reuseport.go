@@ -0,0 +1,85 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Listen on UDP bind address, optionally with SO_REUSEPORT option, so
+// several sockets can be bound to the same address and kernel
+// distributes incoming packets among them.
+func udpListen(reusePort bool) (*net.UDPConn, error) {
+	bind, err := net.ResolveUDPAddr("udp", *bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !reusePort {
+		return net.ListenUDP("udp", bind)
+	}
+	family := syscall.AF_INET6
+	var sa syscall.Sockaddr
+	if ip4 := bind.IP.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		sa4 := &syscall.SockaddrInet4{Port: bind.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: bind.Port}
+		copy(sa6.Addr[:], bind.IP.To16())
+		if bind.Zone != "" {
+			iface, err := net.InterfaceByName(bind.Zone)
+			if err != nil {
+				return nil, err
+			}
+			sa6.ZoneId = uint32(iface.Index)
+		}
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Accept IPv4 too on IPv6 socket, like net.ListenUDP does
+	if family == syscall.AF_INET6 && (bind.IP == nil || bind.IP.IsUnspecified()) {
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "udp")
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,63 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RoamPeriod = time.Second
+)
+
+// Limiter of roaming attempts. Each attempt tries to authenticate the
+// packet with all UDP peers' keys, so every source IP address is
+// allowed to make single attempt per RoamPeriod, and no more than max
+// attempts are made in total during it. Otherwise each spoofed packet
+// would cost as many decryptions as there are peers.
+type roamLimiter struct {
+	max    int
+	seen   map[string]struct{}
+	period time.Time
+	l      sync.Mutex
+}
+
+func newRoamLimiter(max int) *roamLimiter {
+	return &roamLimiter{max: max, seen: make(map[string]struct{})}
+}
+
+// Check if roaming attempt from that source IP address is allowed now
+// and remember it.
+func (r *roamLimiter) allow(ip string, now time.Time) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if now.Sub(r.period) >= RoamPeriod {
+		r.period = now
+		r.seen = make(map[string]struct{})
+	}
+	if len(r.seen) >= r.max {
+		return false
+	}
+	if _, exists := r.seen[ip]; exists {
+		return false
+	}
+	r.seen[ip] = struct{}{}
+	return true
+}
@@ -0,0 +1,45 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoamLimiter(t *testing.T) {
+	r := newRoamLimiter(2)
+	now := time.Now()
+	if !r.allow("192.0.2.1", now) {
+		t.Fatal("first attempt rejected")
+	}
+	if r.allow("192.0.2.1", now) {
+		t.Fatal("repeated attempt from the same source allowed")
+	}
+	if !r.allow("192.0.2.2", now) {
+		t.Fatal("another source rejected")
+	}
+	if r.allow("192.0.2.3", now) {
+		t.Fatal("attempts above the limit allowed")
+	}
+	now = now.Add(RoamPeriod)
+	if !r.allow("192.0.2.1", now) || !r.allow("192.0.2.3", now) {
+		t.Fatal("attempts rejected in the next period")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	// How long to wait for transports and down-scripts during the
+	// shutdown
+	ShutdownTimeout = 10 * time.Second
+)
+
+// Remember listener, socket or connection served by the goroutine, that
+// must call transportDone when finished. False is returned if the
+// shutdown is already started: it must be closed at once then.
+func transportAdd(c io.Closer) bool {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if stopping {
+		return false
+	}
+	transports[c] = struct{}{}
+	running.Add(1)
+	return true
+}
+
+func transportDone(c io.Closer) {
+	transportsLock.Lock()
+	delete(transports, c)
+	transportsLock.Unlock()
+	running.Done()
+}
+
+// Is shutdown started, so closed transports' errors are expected.
+func stopped() bool {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	return stopping
+}
+
+// Wait for the group until the deadline. False is returned if it is
+// timeouted.
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(deadline.Sub(time.Now())):
+		return false
+	}
+}
+
+// Say goodbye to all peers, so they reconnect at once. Then close all
+// listeners, sockets and connections and wait for their goroutines
+// and UDP workers, so nothing processes packets anymore. Only then
+// half-open handshakes and peers are zeroed, peers are deleted and
+// their down-scripts are waited for.
+func shutdown() {
+	peersLock.RLock()
+	for _, ps := range peers {
+		ps.peer.Goodbye(govpn.GoodbyeShutdown)
+	}
+	peersLock.RUnlock()
+
+	transportsLock.Lock()
+	stopping = true
+	for c := range transports {
+		c.Close()
+	}
+	transportsLock.Unlock()
+	deadline := time.Now().Add(ShutdownTimeout)
+	if !waitUntil(&running, deadline) {
+		govpn.Printf(`[shutdown-timeouted bind="%s" wait="transports"]`, *bindAddr)
+	}
+
+	hsLock.Lock()
+	for addr, hs := range handshakes {
+		hs.Zero()
+		hsDel(addr)
+	}
+	hsLock.Unlock()
+
+	peersLock.Lock()
+	peersByIdLock.Lock()
+	kpLock.Lock()
+	for addr, ps := range peers {
+		govpn.Printf(`[peer-delete bind="%s" peer="%s"]`, *bindAddr, ps.peer)
+		peerDelete(addr, ps)
+	}
+	peersLock.Unlock()
+	peersByIdLock.Unlock()
+	kpLock.Unlock()
+
+	if !waitUntil(&scripts, deadline) {
+		govpn.Printf(`[shutdown-timeouted bind="%s" wait="scripts"]`, *bindAddr)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+// Make verifier of the new peer and its private key.
+func testPeerConf(t *testing.T) (*govpn.Verifier, *[64]byte) {
+	id := new(govpn.PeerId)
+	if _, err := io.ReadFull(govpn.Rand, id[:]); err != nil {
+		t.Fatal(err)
+	}
+	v := govpn.VerifierNew(1<<10, 1<<4, 1, id)
+	return v, v.PasswordApply("does not matter")
+}
+
+// Make client side handshake over the connection, reading server's
+// messages until the peer is established.
+func testHandshake(t *testing.T, conn net.Conn, conf *govpn.PeerConf) *govpn.Peer {
+	hs := govpn.HandshakeStart(conn.RemoteAddr().String(), conn, conf)
+	defer hs.Zero()
+	buf := make([]byte, govpn.MTUMax)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal("handshake failed", err)
+		}
+		if peer := hs.Client(buf[:n]); peer != nil {
+			return peer
+		}
+	}
+}
+
+// Server started with UDP and TCP transports says goodbye to each peer
+// on the termination signal, waits for all its goroutines and calls
+// down-scripts. SIGHUP rereads the configuration before.
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPathPrev, bindAddrPrev, workersPrev := *confPath, *bindAddr, *workers
+	*confPath = path.Join(dir, "peers.yaml")
+	defer func() {
+		*confPath, *bindAddr, *workers = confPathPrev, bindAddrPrev, workersPrev
+		confs = nil
+		transportsLock.Lock()
+		stopping = false
+		transportsLock.Unlock()
+	}()
+
+	vU, dsaPrivU := testPeerConf(t)
+	vT, dsaPrivT := testPeerConf(t)
+	down := path.Join(dir, "down.sh")
+	if err = ioutil.WriteFile(down, []byte("#!/bin/sh\ntouch "+down+".done\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	conf := []byte(
+		"alice: {switch: shutdown, down: " + down +
+			", verifier: \"" + vU.LongForm() + "\"}\n" +
+			"bob: {switch: shutdown, verifier: \"" + vT.LongForm() + "\"}\n",
+	)
+	if err = ioutil.WriteFile(*confPath, conf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	idsCache = govpn.NewMACCache()
+	if err = confRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	cookies = govpn.NewCookies()
+	roams = newRoamLimiter(1 << 6)
+	if knownPeers == nil {
+		knownPeers = govpn.KnownPeers(make(map[string]**govpn.Peer))
+	}
+
+	// Port is free both for UDP and TCP most probably
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*bindAddr = ln.Addr().String()
+	ln.Close()
+	*workers = 2
+	before := runtime.NumGoroutine()
+	startUDP()
+	startTCP()
+
+	connU, err := net.Dial("udp", *bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connU.Close()
+	confU := *confGet(*vU.Id)
+	confU.DSAPriv = dsaPrivU
+	peerU := testHandshake(t, connU, &confU)
+	connT, err := net.Dial("tcp", *bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connT.Close()
+	confT := *confGet(*vT.Id)
+	confT.DSAPriv = dsaPrivT
+	peerT := testHandshake(t, connT, &confT)
+	for i := 0; ; i++ {
+		peersLock.RLock()
+		n := len(peers)
+		peersLock.RUnlock()
+		if n == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("peers are not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var reasonU, reasonT govpn.GoodbyeReason
+	peerU.GoodbyeHandler = func(r govpn.GoodbyeReason) { reasonU = r }
+	peerT.GoodbyeHandler = func(r govpn.GoodbyeReason) { reasonT = r }
+
+	termSignal := make(chan os.Signal, 1)
+	hupSignal := make(chan os.Signal, 1)
+	served := make(chan struct{})
+	go func() {
+		serve(termSignal, hupSignal, nil, time.Minute)
+		close(served)
+	}()
+	reloads := atomic.LoadUint64(&counters.ConfReloads)
+	hupSignal <- syscall.SIGHUP
+	for i := 0; atomic.LoadUint64(&counters.ConfReloads) == reloads; i++ {
+		if i == 100 {
+			t.Fatal("configuration is not reread")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	termSignal <- syscall.SIGTERM
+	select {
+	case <-served:
+	case <-time.After(ShutdownTimeout + time.Second):
+		t.Fatal("shutdown is not finished")
+	}
+
+	buf := make([]byte, 2*govpn.MTUMax)
+	for reasonU == 0 {
+		connU.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := connU.Read(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			t.Fatal("no goodbye over UDP")
+		}
+		// Closed server's socket can be reported too
+		if err != nil {
+			continue
+		}
+		peerU.PktProcess(buf[:n], ioutil.Discard, true)
+	}
+	// Server closes TCP connection after the goodbye
+	connT.SetReadDeadline(time.Now().Add(time.Second))
+	data, _ := ioutil.ReadAll(connT)
+	for reasonT == 0 {
+		i := bytes.Index(data, peerT.NonceExpect)
+		if i == -1 {
+			t.Fatal("no goodbye over TCP")
+		}
+		peerT.PktProcess(data[:i+govpn.NonceSize], ioutil.Discard, false)
+		data = data[i+govpn.NonceSize:]
+	}
+	if reasonU != govpn.GoodbyeShutdown || reasonT != govpn.GoodbyeShutdown {
+		t.Fatal("unexpected goodbye reasons", reasonU, reasonT)
+	}
+
+	transportsLock.Lock()
+	n := len(transports)
+	transportsLock.Unlock()
+	if n != 0 {
+		t.Fatal("transports are left", n)
+	}
+	peersLock.RLock()
+	n = len(peers)
+	peersLock.RUnlock()
+	if n != 0 {
+		t.Fatal("peers are left", n)
+	}
+	if _, err = os.Stat(down + ".done"); err != nil {
+		t.Fatal("down-script is not called")
+	}
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatal("goroutines are left", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = net.Dial("tcp", *bindAddr); err == nil {
+		t.Fatal("TCP listener is not closed")
+	}
+}
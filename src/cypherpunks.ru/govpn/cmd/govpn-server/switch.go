@@ -0,0 +1,129 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	switches map[string]*govpn.Switch = make(map[string]*govpn.Switch)
+	// Switches' uplink interfaces and quantity of peers using each
+	// interface as its own one: interface can not be both of them
+	uplinks      map[string]string = make(map[string]string)
+	ifaces       map[string]int    = make(map[string]int)
+	switchesLock sync.Mutex
+)
+
+// Get peer's TAP interface: either real one, or the port of virtual
+// switch the peer is attached to. In the latter case ifaceName is an
+// optional switch's uplink interface, and the switch is returned too.
+func tapListen(peer *govpn.Peer, ifaceName string) (*govpn.TAP, *govpn.Switch, error) {
+	conf := confGet(*peer.Id)
+	if conf == nil {
+		return nil, nil, errors.New("Unknown peer: " + peer.Id.String())
+	}
+	switchesLock.Lock()
+	defer switchesLock.Unlock()
+	if conf.Switch == "" {
+		if swName, exists := uplinks[ifaceName]; exists {
+			return nil, nil, errors.New("Interface " + ifaceName + " is uplink of switch " + swName)
+		}
+		tap, err := govpn.TAPListen(ifaceName, peer.MTU, peer.Mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		ifaces[ifaceName]++
+		return tap, nil, nil
+	}
+	sw, exists := switches[conf.Switch]
+	if !exists {
+		var uplink *govpn.TAP
+		if ifaceName != "" {
+			if _, exists = ifaces[ifaceName]; exists {
+				return nil, nil, errors.New("Interface " + ifaceName + " is used by peers directly")
+			}
+			if swName, exists := uplinks[ifaceName]; exists {
+				return nil, nil, errors.New("Interface " + ifaceName + " is uplink of switch " + swName)
+			}
+			var err error
+			uplink, err = govpn.TAPListen(ifaceName, govpn.MTUMax, govpn.ModeTAP)
+			if err != nil {
+				return nil, nil, err
+			}
+			uplinks[ifaceName] = conf.Switch
+		}
+		sw = govpn.NewSwitch(conf.Switch, uplink)
+		switches[conf.Switch] = sw
+		govpn.Printf(
+			`[switch-created bind="%s" switch="%s" uplink="%s"]`,
+			*bindAddr, conf.Switch, ifaceName,
+		)
+	}
+	return sw.PortAdd(), sw, nil
+}
+
+// Detach peer's TAP from the switch it was attached to, deleting the
+// switch and releasing its uplink when no ports are left. Otherwise
+// release peer's own interface, closing it if it is not used anymore.
+func tapRelease(peerId *govpn.PeerId, tap *govpn.TAP, sw *govpn.Switch) {
+	switchesLock.Lock()
+	defer switchesLock.Unlock()
+	if sw != nil {
+		sw.PortDel(tap)
+		uplink := sw.Uplink()
+		ports := sw.PortsNum()
+		if uplink != nil {
+			ports--
+		}
+		if ports > 0 {
+			return
+		}
+		sw.Close()
+		delete(switches, sw.Name)
+		govpn.Printf(`[switch-deleted bind="%s" switch="%s"]`, *bindAddr, sw.Name)
+		if uplink == nil {
+			return
+		}
+		delete(uplinks, uplink.Name)
+		tap = uplink
+	} else if ifaces[tap.Name] <= 1 {
+		delete(ifaces, tap.Name)
+	} else {
+		ifaces[tap.Name]--
+	}
+	if err := govpn.TAPRelease(tap); err != nil {
+		govpn.Printf(
+			`[tap-release-failed bind="%s" peer="%s" err="%s"]`,
+			*bindAddr, peerId.String(), err,
+		)
+	}
+}
+
+func switchesAge(now time.Time) {
+	switchesLock.Lock()
+	for _, sw := range switches {
+		sw.Age(now)
+	}
+	switchesLock.Unlock()
+}
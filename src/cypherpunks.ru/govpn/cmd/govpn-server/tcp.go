@@ -20,8 +20,10 @@ package main
 
 import (
 	"bytes"
+	"io"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
@@ -37,15 +39,27 @@ func startTCP() {
 		log.Fatalln("Can not listen on TCP:", err)
 	}
 	govpn.BothPrintf(`[tcp-listen bind="%s"]`, *bindAddr)
+	transportAdd(listener)
 	go func() {
 		for {
 			conn, err := listener.AcceptTCP()
 			if err != nil {
+				if stopped() {
+					break
+				}
 				govpn.Printf(`[tcp-accept-failed bind="%s" err="%s"]`, *bindAddr, err)
 				continue
 			}
-			go handleTCP(conn)
+			if !transportAdd(conn) {
+				conn.Close()
+				continue
+			}
+			go func(conn net.Conn) {
+				handleTCP(conn)
+				transportDone(conn)
+			}(conn)
 		}
+		transportDone(listener)
 	}()
 }
 
@@ -56,10 +70,10 @@ func handleTCP(conn net.Conn) {
 	var err error
 	var prev int
 	var hs *govpn.Handshake
-	var ps *PeerState
 	var peer *govpn.Peer
 	var tap *govpn.TAP
 	var conf *govpn.PeerConf
+	var completed bool
 	for {
 		if prev == len(buf) {
 			break
@@ -76,7 +90,7 @@ func handleTCP(conn net.Conn) {
 			continue
 		}
 		if hs == nil {
-			conf = confs[*peerId]
+			conf = confGet(*peerId)
 			if conf == nil {
 				govpn.Printf(
 					`[conf-get-failed bind="%s" peer="%s"]`,
@@ -84,7 +98,11 @@ func handleTCP(conn net.Conn) {
 				)
 				break
 			}
-			hs = govpn.NewHandshake(addr, conn, conf)
+			// Length-prefixed framing is allowed only for TCP
+			hsConf := *conf
+			hsConf.Framed = true
+			hs = govpn.NewHandshake(addr, conn, &hsConf)
+			atomic.AddUint64(&counters.HandshakesStarted, 1)
 		}
 		peer = hs.Server(buf[:prev])
 		prev = 0
@@ -92,73 +110,23 @@ func handleTCP(conn net.Conn) {
 			continue
 		}
 		hs.Zero()
+		completed = true
 		govpn.Printf(
 			`[handshake-completed bind="%s" addr="%s" peer="%s"]`,
 			*bindAddr, addr, peerId.String(),
 		)
-		peersByIdLock.RLock()
-		addrPrev, exists := peersById[*peer.Id]
-		peersByIdLock.RUnlock()
-		if exists {
-			peersLock.Lock()
-			peers[addrPrev].terminator <- struct{}{}
-			tap = peers[addrPrev].tap
-			ps = &PeerState{
-				peer:       peer,
-				tap:        tap,
-				terminator: make(chan struct{}),
-			}
-			go govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
-			peersByIdLock.Lock()
-			kpLock.Lock()
-			delete(peers, addrPrev)
-			delete(knownPeers, addrPrev)
-			peers[addr] = ps
-			knownPeers[addr] = &peer
-			peersById[*peer.Id] = addr
-			peersLock.Unlock()
-			peersByIdLock.Unlock()
-			kpLock.Unlock()
-			govpn.Printf(
-				`[rehandshake-completed bind="%s" peer="%s"]`,
-				*bindAddr, peerId.String(),
-			)
-		} else {
-			ifaceName, err := callUp(peer.Id, peer.Addr)
-			if err != nil {
-				peer = nil
-				break
-			}
-			tap, err = govpn.TAPListen(ifaceName, peer.MTU)
-			if err != nil {
-				govpn.Printf(
-					`[tap-failed bind="%s" peer="%s" err="%s"]`,
-					*bindAddr, peerId.String(), err,
-				)
-				peer = nil
-				break
-			}
-			ps = &PeerState{
-				peer:       peer,
-				tap:        tap,
-				terminator: make(chan struct{}, 1),
-			}
-			go govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
-			peersLock.Lock()
-			peersByIdLock.Lock()
-			kpLock.Lock()
-			peers[addr] = ps
-			peersById[*peer.Id] = addr
-			knownPeers[addr] = &peer
-			peersLock.Unlock()
-			peersByIdLock.Unlock()
-			kpLock.Unlock()
-			govpn.Printf(`[peer-created bind="%s" peer="%s"]`, *bindAddr, peerId.String())
+		atomic.AddUint64(&counters.HandshakesCompleted, 1)
+		tap = streamPeerStart(addr, peer, conn)
+		if tap == nil {
+			peer = nil
 		}
 		break
 	}
 	if hs != nil {
 		hs.Zero()
+		if !completed {
+			atomic.AddUint64(&counters.HandshakesFailed, 1)
+		}
 	}
 	if peer == nil {
 		return
@@ -166,6 +134,7 @@ func handleTCP(conn net.Conn) {
 
 	prev = 0
 	var i int
+	var pkt []byte
 	for {
 		if prev == len(buf) {
 			break
@@ -177,6 +146,9 @@ func handleTCP(conn net.Conn) {
 			break
 		}
 		prev += n
+		if peer.Framed {
+			goto CheckFramed
+		}
 	CheckMore:
 		if prev < govpn.MinPktLength {
 			continue
@@ -195,6 +167,105 @@ func handleTCP(conn net.Conn) {
 		copy(buf, buf[i+govpn.NonceSize:prev])
 		prev = prev - i - govpn.NonceSize
 		goto CheckMore
+	CheckFramed:
+		pkt, i = peer.FrameNext(buf[:prev], len(buf))
+		if i == 0 {
+			continue
+		}
+		if i < 0 {
+			govpn.Printf(
+				`[packet-too-big bind="%s" addr="%s" peer="%s"]`,
+				*bindAddr, addr, peer.Id.String(),
+			)
+			break
+		}
+		if !peer.PktProcess(pkt, tap, false) {
+			govpn.Printf(
+				`[packet-unauthenticated bind="%s" addr="%s" peer="%s"]`,
+				*bindAddr, addr, peer.Id.String(),
+			)
+			break
+		}
+		copy(buf, buf[i:prev])
+		prev -= i
+		goto CheckFramed
 	}
 	peer.Zero()
 }
+
+// Register peer established over stream connection (TCP, WebSocket),
+// either replacing the previous one with the same identity, or
+// creating the new interface for it. nil is returned on failure.
+func streamPeerStart(addr string, peer *govpn.Peer, conn io.Closer) *govpn.TAP {
+	var ps *PeerState
+	peersByIdLock.RLock()
+	addrPrev, exists := peersById[*peer.Id]
+	peersByIdLock.RUnlock()
+	if exists {
+		peersLock.Lock()
+		close(peers[addrPrev].terminator)
+		if peers[addrPrev].conn != nil {
+			peers[addrPrev].conn.Close()
+		}
+		ps = &PeerState{
+			peer:       peer,
+			tap:        peers[addrPrev].tap,
+			sw:         peers[addrPrev].sw,
+			terminator: make(chan struct{}),
+			conn:       conn,
+		}
+		ps.peer.GoodbyeHandler = peerGoodbye(ps)
+		mtuStart(ps.peer, ps.tap)
+		pushStart(ps.peer, ps.tap)
+		go govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
+		peersByIdLock.Lock()
+		kpLock.Lock()
+		delete(peers, addrPrev)
+		delete(knownPeers, addrPrev)
+		peers[addr] = ps
+		knownPeers[addr] = &peer
+		peersById[*peer.Id] = addr
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+		govpn.Printf(
+			`[rehandshake-completed bind="%s" peer="%s"]`,
+			*bindAddr, peer.Id.String(),
+		)
+		return ps.tap
+	}
+	ifaceName, err := callUp(peer)
+	if err != nil {
+		return nil
+	}
+	tap, sw, err := tapListen(peer, ifaceName)
+	if err != nil {
+		govpn.Printf(
+			`[tap-failed bind="%s" peer="%s" err="%s"]`,
+			*bindAddr, peer.Id.String(), err,
+		)
+		return nil
+	}
+	ps = &PeerState{
+		peer:       peer,
+		tap:        tap,
+		sw:         sw,
+		terminator: make(chan struct{}),
+		conn:       conn,
+	}
+	ps.peer.GoodbyeHandler = peerGoodbye(ps)
+	mtuStart(ps.peer, ps.tap)
+	pushStart(ps.peer, ps.tap)
+	go govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
+	peersLock.Lock()
+	peersByIdLock.Lock()
+	kpLock.Lock()
+	peers[addr] = ps
+	peersById[*peer.Id] = addr
+	knownPeers[addr] = &peer
+	peersLock.Unlock()
+	peersByIdLock.Unlock()
+	kpLock.Unlock()
+	govpn.Printf(`[peer-created bind="%s" peer="%s"]`, *bindAddr, peer.Id.String())
+	return tap
+}
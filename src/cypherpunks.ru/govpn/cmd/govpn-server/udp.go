@@ -19,188 +19,374 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"hash/fnv"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
 type UDPSender struct {
-	conn *net.UDPConn
-	addr *net.UDPAddr
+	conn  *net.UDPConn
+	addr  *net.UDPAddr
+	batch *govpn.UDPBatch
+	msgs  []govpn.UDPMsg
 }
 
-func (c UDPSender) Write(data []byte) (int, error) {
+func (c *UDPSender) Write(data []byte) (int, error) {
 	return c.conn.WriteToUDP(data, c.addr)
 }
 
+// Send packets with as few system calls as possible. It is called only
+// by the peer's transmitter, so no locking is needed.
+func (c *UDPSender) WriteBatch(pkts [][]byte) error {
+	if c.batch == nil {
+		c.batch = govpn.NewUDPBatch(c.conn)
+		c.msgs = make([]govpn.UDPMsg, govpn.UDPBatchSize)
+	}
+	msgs := c.msgs[:len(pkts)]
+	for i, pkt := range pkts {
+		msgs[i] = govpn.UDPMsg{Buf: pkt, N: len(pkt), Addr: c.addr}
+	}
+	return c.batch.Write(msgs)
+}
+
+const (
+	// Preallocated receive buffers per UDP worker
+	UDPBufsPerWorker = 1 << 6
+)
+
+// Transport packet received from the known peer.
+type udpPkt struct {
+	peer *govpn.Peer
+	tap  *govpn.TAP
+	buf  []byte
+	n    int
+}
+
 var (
-	// Buffers for UDP parallel processing
-	udpBufs chan []byte = make(chan []byte, 1<<8)
+	// Preallocated buffers for UDP parallel processing
+	udpBufs chan []byte
 )
 
 func startUDP() {
-	bind, err := net.ResolveUDPAddr("udp", *bindAddr)
-	if err != nil {
-		log.Fatalln("Can not resolve bind address:", err)
+	workers := *workers
+	if workers < 1 {
+		workers = 1
 	}
-	conn, err := net.ListenUDP("udp", bind)
-	if err != nil {
-		log.Fatalln("Can not listen on UDP:", err)
+	udpBufs = make(chan []byte, workers*UDPBufsPerWorker)
+	for i := 0; i < cap(udpBufs); i++ {
+		udpBufs <- make([]byte, govpn.MTUMax)
+	}
+	shards := make([]chan udpPkt, workers)
+	for i := 0; i < workers; i++ {
+		shards[i] = make(chan udpPkt, UDPBufsPerWorker)
+		running.Add(1)
+		go func(pkts chan udpPkt) {
+			udpWorker(pkts)
+			running.Done()
+		}(shards[i])
+	}
+	sockets := 1
+	if *reuse {
+		sockets = workers
+	}
+	// Workers are finished when all readers are
+	var readers sync.WaitGroup
+	for i := 0; i < sockets; i++ {
+		conn, err := udpListen(*reuse)
+		if err != nil {
+			log.Fatalln("Can not listen on UDP:", err)
+		}
+		transportAdd(conn)
+		readers.Add(1)
+		go func(conn *net.UDPConn) {
+			udpReader(conn, shards)
+			readers.Done()
+			transportDone(conn)
+		}(conn)
 	}
-	govpn.BothPrintf(`[udp-listen bind="%s"]`, *bindAddr)
-
-	udpBufs <- make([]byte, govpn.MTUMax)
 	go func() {
-		var buf []byte
-		var raddr *net.UDPAddr
-		var addr string
-		var n int
-		var err error
-		var ps *PeerState
-		var hs *govpn.Handshake
-		var addrPrev string
-		var exists bool
-		var peerId *govpn.PeerId
-		var peer *govpn.Peer
-		var conf *govpn.PeerConf
-		for {
-			buf = <-udpBufs
-			n, raddr, err = conn.ReadFromUDP(buf)
-			if err != nil {
-				govpn.Printf(`[receive-failed bind="%s" err="%s"]`, *bindAddr, err)
-				break
-			}
-			addr = raddr.String()
+		readers.Wait()
+		for _, shard := range shards {
+			close(shard)
+		}
+	}()
+	govpn.BothPrintf(
+		`[udp-listen bind="%s" workers="%d" sockets="%d"]`,
+		*bindAddr, workers, sockets,
+	)
+}
+
+// Process packets of the peers sharded to that worker. Each peer is
+// always processed by the same worker, so workers do not contend on
+// the peer's locks.
+func udpWorker(pkts chan udpPkt) {
+	for pkt := range pkts {
+		pkt.peer.PktProcess(pkt.buf[:pkt.n], pkt.tap, true)
+		udpBufs <- pkt.buf
+	}
+}
 
-			peersLock.RLock()
-			ps, exists = peers[addr]
-			peersLock.RUnlock()
-			if !exists {
-				goto CheckHandshake
+func udpShard(addr string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(addr))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func udpReader(conn *net.UDPConn, shards []chan udpPkt) {
+	batch := govpn.NewUDPBatch(conn)
+	msgs := make([]govpn.UDPMsg, govpn.UDPBatchSize)
+	var cnt int
+	var err error
+	for {
+		for i := 0; i < len(msgs); i++ {
+			if msgs[i].Buf == nil {
+				msgs[i].Buf = <-udpBufs
 			}
-			go func(ps *govpn.Peer, tap *govpn.TAP, buf []byte, n int) {
-				peer.PktProcess(buf[:n], tap, true)
-				udpBufs <- buf
-			}(ps.peer, ps.tap, buf, n)
-			continue
-		CheckHandshake:
-			hsLock.RLock()
-			hs, exists = handshakes[addr]
-			hsLock.RUnlock()
-			if !exists {
-				goto CheckID
+		}
+		cnt, err = batch.Read(msgs)
+		if err != nil {
+			if !stopped() {
+				govpn.Printf(`[receive-failed bind="%s" err="%s"]`, *bindAddr, err)
 			}
-			peer = hs.Server(buf[:n])
-			if peer == nil {
-				goto Finished
+			break
+		}
+		for i := 0; i < cnt; i++ {
+			if udpProcess(conn, shards, msgs[i].Buf, msgs[i].N, msgs[i].Addr) {
+				msgs[i].Buf = nil
 			}
+		}
+	}
+	for i := 0; i < len(msgs); i++ {
+		if msgs[i].Buf != nil {
+			udpBufs <- msgs[i].Buf
+		}
+	}
+}
 
-			govpn.Printf(
-				`[handshake-completed bind="%s" addr="%s" peer="%s"]`,
-				*bindAddr, addr, peerId.String(),
-			)
-			hs.Zero()
-			hsLock.Lock()
-			delete(handshakes, addr)
-			hsLock.Unlock()
-
-			go func() {
-				udpBufs <- make([]byte, govpn.MTUMax)
-				udpBufs <- make([]byte, govpn.MTUMax)
-			}()
-			peersByIdLock.RLock()
-			addrPrev, exists = peersById[*peer.Id]
-			peersByIdLock.RUnlock()
-			if exists {
-				peersLock.Lock()
-				peers[addrPrev].terminator <- struct{}{}
-				ps = &PeerState{
-					peer:       peer,
-					tap:        peers[addrPrev].tap,
-					terminator: make(chan struct{}),
-				}
-				go func(ps PeerState) {
-					govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
-					<-udpBufs
-					<-udpBufs
-				}(*ps)
-				peersByIdLock.Lock()
-				kpLock.Lock()
-				delete(peers, addrPrev)
-				delete(knownPeers, addrPrev)
-				peers[addr] = ps
-				knownPeers[addr] = &peer
-				peersById[*peer.Id] = addr
-				peersLock.Unlock()
-				peersByIdLock.Unlock()
-				kpLock.Unlock()
-				govpn.Printf(
-					`[rehandshake-completed bind="%s" peer="%s"]`,
-					*bindAddr, peer.Id.String(),
-				)
-			} else {
-				go func(addr string, peer *govpn.Peer) {
-					ifaceName, err := callUp(peer.Id, peer.Addr)
-					if err != nil {
-						return
-					}
-					tap, err := govpn.TAPListen(ifaceName, peer.MTU)
-					if err != nil {
-						govpn.Printf(
-							`[tap-failed bind="%s" peer="%s" err="%s"]`,
-							*bindAddr, peer.Id.String(), err,
-						)
-						return
-					}
-					ps = &PeerState{
-						peer:       peer,
-						tap:        tap,
-						terminator: make(chan struct{}),
-					}
-					go func(ps PeerState) {
-						govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
-						<-udpBufs
-						<-udpBufs
-					}(*ps)
-					peersLock.Lock()
-					peersByIdLock.Lock()
-					kpLock.Lock()
-					peers[addr] = ps
-					knownPeers[addr] = &peer
-					peersById[*peer.Id] = addr
-					peersLock.Unlock()
-					peersByIdLock.Unlock()
-					kpLock.Unlock()
-					govpn.Printf(`[peer-created bind="%s" peer="%s"]`, *bindAddr, peer.Id.String())
-				}(addr, peer)
-			}
-			goto Finished
-		CheckID:
-			peerId = idsCache.Find(buf[:n])
-			if peerId == nil {
-				govpn.Printf(`[identity-unknown bind="%s" addr="%s"]`, *bindAddr, addr)
-				goto Finished
+// Process single received datagram. True is returned if buffer is
+// passed to the worker and must not be reused by the reader.
+func udpProcess(conn *net.UDPConn, shards []chan udpPkt, buf []byte, n int, raddr *net.UDPAddr) bool {
+	var addr string
+	var ps *PeerState
+	var hs *govpn.Handshake
+	var addrPrev string
+	var exists bool
+	var peerId *govpn.PeerId
+	var peer *govpn.Peer
+	var conf *govpn.PeerConf
+	var hsNum, hsPeerNum int
+	addr = raddr.String()
+
+	peersLock.RLock()
+	ps, exists = peers[addr]
+	peersLock.RUnlock()
+	if !exists {
+		goto CheckHandshake
+	}
+	shards[udpShard(addr, len(shards))] <- udpPkt{ps.peer, ps.tap, buf, n}
+	return true
+CheckHandshake:
+	hsLock.RLock()
+	hs, exists = handshakes[addr]
+	hsLock.RUnlock()
+	if !exists {
+		goto CheckID
+	}
+	peer = hs.Server(buf[:n])
+	if peer == nil {
+		goto Finished
+	}
+	peer.PMTUDiscovery = true
+
+	govpn.Printf(
+		`[handshake-completed bind="%s" addr="%s" peer="%s"]`,
+		*bindAddr, addr, peer.Id.String(),
+	)
+	atomic.AddUint64(&counters.HandshakesCompleted, 1)
+	hs.Zero()
+	hsLock.Lock()
+	hsDel(addr)
+	hsLock.Unlock()
+
+	peersByIdLock.RLock()
+	addrPrev, exists = peersById[*peer.Id]
+	peersByIdLock.RUnlock()
+	if exists {
+		peersLock.Lock()
+		close(peers[addrPrev].terminator)
+		if peers[addrPrev].conn != nil {
+			peers[addrPrev].conn.Close()
+		}
+		ps = &PeerState{
+			peer:       peer,
+			tap:        peers[addrPrev].tap,
+			sw:         peers[addrPrev].sw,
+			terminator: make(chan struct{}),
+		}
+		ps.peer.GoodbyeHandler = peerGoodbye(ps)
+		go func(ps PeerState) {
+			mtuStart(ps.peer, ps.tap)
+			pushStart(ps.peer, ps.tap)
+			govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
+		}(*ps)
+		peersByIdLock.Lock()
+		kpLock.Lock()
+		delete(peers, addrPrev)
+		delete(knownPeers, addrPrev)
+		peers[addr] = ps
+		knownPeers[addr] = &peer
+		peersById[*peer.Id] = addr
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+		govpn.Printf(
+			`[rehandshake-completed bind="%s" peer="%s"]`,
+			*bindAddr, peer.Id.String(),
+		)
+	} else {
+		go func(addr string, peer *govpn.Peer) {
+			ifaceName, err := callUp(peer)
+			if err != nil {
+				return
 			}
-			conf = confs[*peerId]
-			if conf == nil {
+			tap, sw, err := tapListen(peer, ifaceName)
+			if err != nil {
 				govpn.Printf(
-					`[conf-get-failed bind="%s" peer="%s"]`,
-					*bindAddr, peerId.String(),
+					`[tap-failed bind="%s" peer="%s" err="%s"]`,
+					*bindAddr, peer.Id.String(), err,
 				)
-				goto Finished
+				return
+			}
+			ps = &PeerState{
+				peer:       peer,
+				tap:        tap,
+				sw:         sw,
+				terminator: make(chan struct{}),
 			}
-			hs = govpn.NewHandshake(
-				addr,
-				UDPSender{conn: conn, addr: raddr},
-				conf,
-			)
-			hs.Server(buf[:n])
-			hsLock.Lock()
-			handshakes[addr] = hs
-			hsLock.Unlock()
-		Finished:
-			udpBufs <- buf
+			ps.peer.GoodbyeHandler = peerGoodbye(ps)
+			go func(ps PeerState) {
+				mtuStart(ps.peer, ps.tap)
+				pushStart(ps.peer, ps.tap)
+				govpn.PeerTapProcessor(ps.peer, ps.tap, ps.terminator)
+			}(*ps)
+			peersLock.Lock()
+			peersByIdLock.Lock()
+			kpLock.Lock()
+			peers[addr] = ps
+			knownPeers[addr] = &peer
+			peersById[*peer.Id] = addr
+			peersLock.Unlock()
+			peersByIdLock.Unlock()
+			kpLock.Unlock()
+			govpn.Printf(`[peer-created bind="%s" peer="%s"]`, *bindAddr, peer.Id.String())
+		}(addr, peer)
+	}
+	goto Finished
+CheckID:
+	peerId = idsCache.Find(buf[:n])
+	if peerId == nil && udpRoam(conn, raddr, buf[:n]) {
+		goto Finished
+	}
+	if peerId == nil {
+		govpn.Printf(`[identity-unknown bind="%s" addr="%s"]`, *bindAddr, addr)
+		atomic.AddUint64(&counters.IdentityUnknown, 1)
+		goto Finished
+	}
+	conf = confGet(*peerId)
+	if conf == nil {
+		govpn.Printf(
+			`[conf-get-failed bind="%s" peer="%s"]`,
+			*bindAddr, peerId.String(),
+		)
+		goto Finished
+	}
+	hsLock.RLock()
+	hsNum = len(handshakes)
+	hsPeerNum = hsPerPeer[*peerId]
+	hsLock.RUnlock()
+	hs = govpn.NewHandshake(
+		addr,
+		&UDPSender{conn: conn, addr: raddr},
+		conf,
+	)
+	// Under the load require the proof of address ownership
+	// before making any expensive computations
+	if hsNum >= *cookieHs {
+		if !cookies.Valid(addr, hs.Cookie(buf[:n])) {
+			hs.CookieSend(buf[:n], cookies.Gen(addr))
+			hs.Zero()
+			atomic.AddUint64(&counters.CookiesSent, 1)
+			goto Finished
 		}
-	}()
+		atomic.AddUint64(&counters.CookiesAccepted, 1)
+	}
+	if hsNum >= *hsMax || hsPeerNum >= *hsPeer {
+		govpn.Printf(
+			`[handshake-limited bind="%s" addr="%s" peer="%s"]`,
+			*bindAddr, addr, peerId.String(),
+		)
+		hs.Zero()
+		atomic.AddUint64(&counters.HandshakesLimited, 1)
+		goto Finished
+	}
+	hs.Server(buf[:n])
+	hsLock.Lock()
+	hsAdd(addr, hs)
+	hsLock.Unlock()
+	atomic.AddUint64(&counters.HandshakesStarted, 1)
+Finished:
+	return false
+}
+
+// Try to authenticate packet from unknown address with the known UDP
+// peers' keys. If it succeeds and packet is not replayed, then peer
+// has changed its address (for example NAT mapping) and it is moved
+// to the new one. Attempts are limited, as each of them is expensive.
+func udpRoam(conn *net.UDPConn, raddr *net.UDPAddr, data []byte) bool {
+	if !roams.allow(raddr.IP.String(), time.Now()) {
+		atomic.AddUint64(&counters.RoamsLimited, 1)
+		return false
+	}
+	addr := raddr.String()
+	peersLock.RLock()
+	states := make([]*PeerState, 0, len(peers))
+	for _, ps := range peers {
+		// Only UDP peers have no stream connection
+		if ps.conn == nil {
+			states = append(states, ps)
+		}
+	}
+	peersLock.RUnlock()
+	for _, ps := range states {
+		if !ps.peer.PktRoam(data, ps.tap) {
+			continue
+		}
+		peersLock.Lock()
+		peersByIdLock.Lock()
+		kpLock.Lock()
+		addrPrev, exists := peersById[*ps.peer.Id]
+		if exists && peers[addrPrev] == ps {
+			delete(peers, addrPrev)
+			delete(knownPeers, addrPrev)
+			peers[addr] = ps
+			knownPeers[addr] = &ps.peer
+			peersById[*ps.peer.Id] = addr
+		}
+		ps.peer.Roam(addr, &UDPSender{conn: conn, addr: raddr})
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+		govpn.Printf(
+			`[peer-roamed bind="%s" peer="%s" prev="%s" addr="%s"]`,
+			*bindAddr, ps.peer.Id.String(), addrPrev, addr,
+		)
+		atomic.AddUint64(&counters.Roams, 1)
+		return true
+	}
+	return false
 }
@@ -0,0 +1,254 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	// Quantity of clients with distinct source addresses
+	BenchClients = 1 << 8
+	// Packets each sender may have in flight before waiting for
+	// the workers, so socket buffers never overflow
+	BenchWindow = 1 << 5
+)
+
+// Client's connection: captures handshake messages until the UDP
+// socket is attached.
+type benchWire struct {
+	conn *net.UDPConn
+	buf  []byte
+	sent uint64
+}
+
+func (w *benchWire) Write(data []byte) (int, error) {
+	if w.conn == nil {
+		w.buf = append(w.buf[:0], data...)
+		return len(data), nil
+	}
+	w.sent += uint64(len(data))
+	return w.conn.Write(data)
+}
+
+type benchClient struct {
+	wire  *benchWire
+	peer  *govpn.Peer
+	peerS *govpn.Peer
+	frame []byte
+}
+
+// Make both client's and server's peers through the real handshake.
+// Server's peer writes to the capturing connection.
+func benchHandshake(tb testing.TB, conf *govpn.PeerConf, addr string) (*govpn.Peer, *govpn.Peer, *benchWire) {
+	wireC := new(benchWire)
+	wireS := new(benchWire)
+	hsS := govpn.NewHandshake(addr, wireS, conf)
+	hsC := govpn.HandshakeStart(addr, wireC, conf)
+	hsS.Server(wireC.buf)
+	hsC.Client(wireS.buf)
+	peerS := hsS.Server(wireC.buf)
+	peerC := hsC.Client(wireS.buf)
+	hsS.Zero()
+	hsC.Zero()
+	if peerS == nil || peerC == nil {
+		tb.Fatal("handshake failed")
+	}
+	return peerC, peerS, wireC
+}
+
+func benchReceived(clients []*benchClient) (sent, received uint64) {
+	for _, c := range clients {
+		sent += c.wire.sent
+		received += atomic.LoadUint64(&c.peerS.BytesIn)
+	}
+	return
+}
+
+// Wait until no more than window bytes are in flight. False is
+// returned if the workers made no progress for a second: the
+// datagrams were lost.
+func benchWait(clients []*benchClient, window uint64) bool {
+	var prev uint64
+	last := time.Now()
+	for {
+		sent, received := benchReceived(clients)
+		if sent-received <= window {
+			return true
+		}
+		if received != prev {
+			prev = received
+			last = time.Now()
+		} else if time.Since(last) > time.Second {
+			return false
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+// Drive the whole UDP receiving pipeline over the loopback: SO_REUSEPORT
+// sockets, readers with batched receiving, udpBufs pool, sharding and
+// workers decrypting packets of many peers into their switch ports.
+func BenchmarkUDPPipeline(b *testing.B) {
+	// Worker and socket per -cpu core, like the default setup
+	nworkers := runtime.GOMAXPROCS(0)
+	bindPrev := *bindAddr
+	reusePrev := *reuse
+	defer func() {
+		*bindAddr = bindPrev
+		*reuse = reusePrev
+	}()
+	*reuse = true
+
+	udpBufs = make(chan []byte, nworkers*UDPBufsPerWorker)
+	for i := 0; i < cap(udpBufs); i++ {
+		udpBufs <- make([]byte, govpn.MTUMax)
+	}
+	shards := make([]chan udpPkt, nworkers)
+	for i := 0; i < nworkers; i++ {
+		shards[i] = make(chan udpPkt, UDPBufsPerWorker)
+		go udpWorker(shards[i])
+	}
+	*bindAddr = "127.0.0.1:0"
+	conns := make([]*net.UDPConn, 0, nworkers)
+	var readers sync.WaitGroup
+	// Readers complain about closed sockets when finishing
+	log.SetOutput(ioutil.Discard)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		readers.Wait()
+		for _, shard := range shards {
+			close(shard)
+		}
+		log.SetOutput(os.Stderr)
+	}()
+	for i := 0; i < nworkers; i++ {
+		conn, err := udpListen(true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, conn)
+		*bindAddr = conn.LocalAddr().String()
+		readers.Add(1)
+		go func() {
+			udpReader(conn, shards)
+			readers.Done()
+		}()
+	}
+
+	id := new(govpn.PeerId)
+	v := govpn.VerifierNew(1<<10, 1<<4, 1, id)
+	conf := &govpn.PeerConf{
+		Id:       id,
+		MTU:      govpn.MTUDefault,
+		Timeout:  time.Second * time.Duration(govpn.TimeoutDefault),
+		Verifier: v,
+		DSAPriv:  v.PasswordApply("does not matter"),
+	}
+	raddr := conns[0].LocalAddr().(*net.UDPAddr)
+	clients := make([]*benchClient, BenchClients)
+	peersLock.Lock()
+	peersPrev := peers
+	peers = make(map[string]*PeerState, BenchClients)
+	peersLock.Unlock()
+	defer func() {
+		peersLock.Lock()
+		peers = peersPrev
+		peersLock.Unlock()
+	}()
+	for i := 0; i < BenchClients; i++ {
+		conn, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		addr := conn.LocalAddr().String()
+		peerC, peerS, wire := benchHandshake(b, conf, addr)
+		wire.conn = conn
+		// Each peer has its own switch, so frames are not flooded
+		// and switches' locks are not shared among the workers
+		sw := govpn.NewSwitch("bench"+strconv.Itoa(i), nil)
+		frame := make([]byte, 1<<7)
+		frame[5] = byte(i)
+		frame[11] = byte(i)
+		clients[i] = &benchClient{wire, peerC, peerS, frame}
+		peersLock.Lock()
+		peers[addr] = &PeerState{peer: peerS, tap: sw.PortAdd()}
+		peersLock.Unlock()
+	}
+	clients[0].peer.EthProcess(clients[0].frame)
+	if !benchWait(clients[:1], 0) {
+		b.Fatal("first packet is lost")
+	}
+	pktSize := clients[0].wire.sent
+
+	var senders int32
+	var lost int32
+	b.SetBytes(int64(len(clients[0].frame)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var mine []*benchClient
+		for {
+			i := int(atomic.AddInt32(&senders, 1)) - 1
+			if i >= len(clients) {
+				break
+			}
+			mine = append(mine, clients[i])
+			if len(mine) == len(clients)/runtime.GOMAXPROCS(0) {
+				break
+			}
+		}
+		if len(mine) == 0 {
+			return
+		}
+		var i int
+		for pb.Next() {
+			c := mine[i%len(mine)]
+			c.peer.EthProcess(c.frame)
+			i++
+			if i%(BenchWindow/4) != 0 {
+				continue
+			}
+			if !benchWait(mine, BenchWindow*pktSize) {
+				atomic.StoreInt32(&lost, 1)
+				return
+			}
+		}
+		if !benchWait(mine, 0) {
+			atomic.StoreInt32(&lost, 1)
+		}
+	})
+	b.StopTimer()
+	if lost != 0 {
+		b.Fatal("datagrams are lost")
+	}
+}
@@ -0,0 +1,146 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+type wsHandler struct{}
+
+func (h wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := govpn.WSUpgrade(w, r)
+	if err != nil {
+		govpn.Printf(
+			`[ws-upgrade-failed bind="%s" addr="%s" err="%s"]`,
+			*bindAddr, r.RemoteAddr, err,
+		)
+		return
+	}
+	if !transportAdd(conn) {
+		conn.Close()
+		return
+	}
+	go func() {
+		handleWS(conn)
+		transportDone(conn)
+	}()
+}
+
+func wsStart() {
+	govpn.BothPrintf(`[ws-listen bind="%s" addr="%s" path="%s"]`, *bindAddr, *wsAddr, *wsPath)
+	mux := http.NewServeMux()
+	mux.Handle(*wsPath, wsHandler{})
+	s := &http.Server{
+		Addr:    *wsAddr,
+		Handler: mux,
+	}
+	if !transportAdd(s) {
+		return
+	}
+	err := s.ListenAndServe()
+	if !stopped() {
+		govpn.BothPrintf(`[ws-finished bind="%s" result="%s"]`, *bindAddr, err)
+	}
+	transportDone(s)
+}
+
+// Each WebSocket message carries single packet, so no frame scanning
+// is required, unlike with TCP.
+func handleWS(conn *govpn.WSConn) {
+	addr := conn.RemoteAddr().String()
+	buf := make([]byte, govpn.EnclessEnlargeSize+2*govpn.MTUMax)
+	var n int
+	var err error
+	var hs *govpn.Handshake
+	var peer *govpn.Peer
+	var tap *govpn.TAP
+	var conf *govpn.PeerConf
+	var completed bool
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(govpn.TimeoutDefault) * time.Second))
+		n, err = conn.Read(buf)
+		if err != nil {
+			break
+		}
+		peerId := idsCache.Find(buf[:n])
+		if peerId == nil {
+			continue
+		}
+		if hs == nil {
+			conf = confGet(*peerId)
+			if conf == nil {
+				govpn.Printf(
+					`[conf-get-failed bind="%s" peer="%s"]`,
+					*bindAddr, peerId.String(),
+				)
+				break
+			}
+			hs = govpn.NewHandshake(addr, conn, conf)
+			atomic.AddUint64(&counters.HandshakesStarted, 1)
+		}
+		peer = hs.Server(buf[:n])
+		if peer == nil {
+			continue
+		}
+		hs.Zero()
+		completed = true
+		govpn.Printf(
+			`[handshake-completed bind="%s" addr="%s" peer="%s"]`,
+			*bindAddr, addr, peerId.String(),
+		)
+		atomic.AddUint64(&counters.HandshakesCompleted, 1)
+		tap = streamPeerStart(addr, peer, conn)
+		if tap == nil {
+			peer = nil
+		}
+		break
+	}
+	if hs != nil {
+		hs.Zero()
+		if !completed {
+			atomic.AddUint64(&counters.HandshakesFailed, 1)
+		}
+	}
+	if peer == nil {
+		conn.Close()
+		return
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(conf.Timeout))
+		n, err = conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if !peer.PktProcess(buf[:n], tap, false) {
+			govpn.Printf(
+				`[packet-unauthenticated bind="%s" addr="%s" peer="%s"]`,
+				*bindAddr, addr, peer.Id.String(),
+			)
+			break
+		}
+	}
+	peer.Zero()
+	conn.Close()
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 
 	"cypherpunks.ru/govpn"
 )
@@ -32,15 +33,54 @@ import (
 var (
 	keyPath  = flag.String("key", "", "Path to passphrase file")
 	verifier = flag.String("verifier", "", "Optional verifier")
-	mOpt     = flag.Int("m", govpn.DefaultM, "Argon2d memory parameter (KiBs)")
-	tOpt     = flag.Int("t", govpn.DefaultT, "Argon2d iteration parameter")
-	pOpt     = flag.Int("p", govpn.DefaultP, "Argon2d parallelizm parameter")
+	alg      = flag.String("alg", "", "Argon2 variant: argon2d (default) or argon2id")
+	mOpt     = flag.Int("m", govpn.DefaultM, "Argon2 memory parameter (KiBs)")
+	tOpt     = flag.Int("t", govpn.DefaultT, "Argon2 iteration parameter")
+	pOpt     = flag.Int("p", govpn.DefaultP, "Argon2 parallelizm parameter")
 	egdPath  = flag.String("egd", "", "Optional path to EGD socket")
 	warranty = flag.Bool("warranty", false, "Print warranty information")
 )
 
+// Create verifier with new hashing parameters for the same peer: old
+// verifier with public key and the passphrase are checked first.
+// Algorithm is left the same, unless explicitly specified.
+func rehash(key string) {
+	if *verifier == "" {
+		log.Fatalln("No verifier specified")
+	}
+	v, err := govpn.VerifierFromString(*verifier)
+	if err != nil {
+		log.Fatalln("Can not decode verifier", err)
+	}
+	if v.Pub == nil {
+		log.Fatalln("Verifier does not contain public key")
+	}
+	pub := *v.Pub
+	v.PasswordApply(key)
+	if !bytes.Equal(v.Pub[:], pub[:]) {
+		log.Fatalln("Passphrase does not match the verifier")
+	}
+	vNew := govpn.VerifierNew(*mOpt, *tOpt, *pOpt, v.Id)
+	vNew.Alg = v.Alg
+	if *alg != "" {
+		vNew.Alg = *alg
+	}
+	if err = vNew.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+	vNew.PasswordApply(key)
+	fmt.Println(vNew.LongForm())
+	fmt.Println(vNew.ShortForm())
+}
+
 func main() {
-	flag.Parse()
+	var rehashing bool
+	if len(os.Args) > 1 && os.Args[1] == "rehash" {
+		rehashing = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 	if *warranty {
 		fmt.Println(govpn.Warranty)
 		return
@@ -52,6 +92,10 @@ func main() {
 	if err != nil {
 		log.Fatalln("Unable to read the key", err)
 	}
+	if rehashing {
+		rehash(key)
+		return
+	}
 	if *verifier == "" {
 		id := new([govpn.IDSize]byte)
 		if _, err = io.ReadFull(govpn.Rand, id[:]); err != nil {
@@ -59,6 +103,12 @@ func main() {
 		}
 		pid := govpn.PeerId(*id)
 		v := govpn.VerifierNew(*mOpt, *tOpt, *pOpt, &pid)
+		if *alg != "" {
+			v.Alg = *alg
+		}
+		if err = v.Validate(); err != nil {
+			log.Fatalln(err)
+		}
 		v.PasswordApply(key)
 		fmt.Println(v.LongForm())
 		fmt.Println(v.ShortForm())
@@ -28,8 +28,10 @@ import (
 const (
 	TimeoutDefault = 60
 	EtherSize      = 14
+	MTUMin         = 576 + 1
 	MTUMax         = 9000 + EtherSize + 1
 	MTUDefault     = 1500 + EtherSize + 1
+	MTUDefaultTUN  = 1500 + 1
 
 	ENV_IFACE  = "GOVPN_IFACE"
 	ENV_REMOTE = "GOVPN_REMOTE"
@@ -44,6 +46,11 @@ var (
 // that will be the first argument when calling it. Function will return
 // it's output and possible error.
 func ScriptCall(path, ifaceName, remoteAddr string) ([]byte, error) {
+	return ScriptCallEnv(path, ifaceName, remoteAddr, nil)
+}
+
+// Same as ScriptCall, but with additional environment variables.
+func ScriptCallEnv(path, ifaceName, remoteAddr string, env []string) ([]byte, error) {
 	if path == "" {
 		return nil, nil
 	}
@@ -53,6 +60,7 @@ func ScriptCall(path, ifaceName, remoteAddr string) ([]byte, error) {
 	cmd := exec.Command(path)
 	cmd.Env = append(cmd.Env, ENV_IFACE+"="+ifaceName)
 	cmd.Env = append(cmd.Env, ENV_REMOTE+"="+remoteAddr)
+	cmd.Env = append(cmd.Env, env...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		log.Println("Script error", path, err, string(out))
@@ -19,28 +19,101 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"errors"
+	"net"
 	"time"
 
 	"github.com/agl/ed25519"
 )
 
+// Virtual network interface mode: either Ethernet frames (TAP) or bare
+// IPv4/IPv6 packets (TUN) are carried through the tunnel.
+type Mode byte
+
+const (
+	ModeTAP Mode = iota
+	ModeTUN
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeTAP:
+		return "tap"
+	case ModeTUN:
+		return "tun"
+	}
+	return "unknown"
+}
+
+func (m Mode) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + m.String() + `"`), nil
+}
+
+// Parse mode's textual representation. Empty string means TAP.
+func ModeFromString(s string) (Mode, error) {
+	switch s {
+	case "", "tap":
+		return ModeTAP, nil
+	case "tun":
+		return ModeTUN, nil
+	}
+	return ModeTAP, errors.New("Unknown mode: " + s)
+}
+
+// Default MTU value for the given mode.
+func MTUDefaultFor(mode Mode) int {
+	if mode == ModeTUN {
+		return MTUDefaultTUN
+	}
+	return MTUDefault
+}
+
 type PeerConf struct {
 	Id          *PeerId       `yaml:"-"`
 	Name        string        `yaml:"name"`
 	Iface       string        `yaml:"iface"`
 	MTU         int           `yaml:"mtu"`
+	ModeRaw     string        `yaml:"mode"`
+	Mode        Mode          `yaml:"-"`
 	Up          string        `yaml:"up"`
 	Down        string        `yaml:"down"`
+	MTUChanged  string        `yaml:"mtu-changed"`
 	TimeoutInt  int           `yaml:"timeout"`
 	Timeout     time.Duration `yaml:"-"`
+	RekeyInt    int           `yaml:"rekey"`
+	Rekey       time.Duration `yaml:"-"`
 	Noise       bool          `yaml:"noise"`
 	CPR         int           `yaml:"cpr"`
 	Encless     bool          `yaml:"encless"`
+	Hybrid      bool          `yaml:"hybrid"`
+	SuitesRaw   []string      `yaml:"suites"`
+	Suites      []Suite       `yaml:"-"`
+	Switch      string        `yaml:"switch"`
+	Pool4Raw    string        `yaml:"pool4"`
+	Pool6Raw    string        `yaml:"pool6"`
+	RoutesRaw   []string      `yaml:"routes"`
+	DNSRaw      []string      `yaml:"dns"`
 	TimeSync    int           `yaml:"timesync"`
 	VerifierRaw string        `yaml:"verifier"`
+	// Size of UDP replay protection window, in packets
+	ReplayWindow int `yaml:"replay-window"`
 
 	// This is passphrase verifier
 	Verifier *Verifier `yaml:"-"`
 	// This field exists only on client's side
 	DSAPriv *[ed25519.PrivateKeySize]byte `yaml:"-"`
+	// Transport's cipher suite proposed by the client
+	Suite Suite `yaml:"-"`
+	// Length-prefixed stream framing proposed by the client, or
+	// allowed by the server
+	Framed bool `yaml:"-"`
+	// Feistel network nonces, always proposed by the client and
+	// accepted by the server, unless one of them is an older version
+	Feistel bool `yaml:"-"`
+
+	// Pushed network configuration, exists only on server's side
+	Pool4  *net.IPNet   `yaml:"-"`
+	Pool6  *net.IPNet   `yaml:"-"`
+	Routes []*net.IPNet `yaml:"-"`
+	DNS    []net.IP     `yaml:"-"`
 }
@@ -0,0 +1,150 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/salsa20"
+)
+
+const (
+	CookieSize = 16
+	// Cookie is valid during the current and the previous periods
+	CookieLifetime = 30 * time.Second
+
+	cookieMarkerSize = 8
+)
+
+// Stateless cookies generator and verifier, binding the cookie to the
+// remote address. It is used by the server to check that client really
+// owns its address before making expensive handshake computations,
+// similarly to DTLS's HelloVerifyRequest.
+type Cookies struct {
+	secret *[32]byte
+}
+
+func NewCookies() *Cookies {
+	secret := new([32]byte)
+	if _, err := io.ReadFull(Rand, secret[:]); err != nil {
+		log.Fatalln("Error reading random for cookie secret:", err)
+	}
+	return &Cookies{secret}
+}
+
+func (c *Cookies) gen(addr string, period int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(period))
+	mac := blake2b.NewMAC(CookieSize, c.secret[:])
+	mac.Write(buf)
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)
+}
+
+// Generate cookie for the given remote address.
+func (c *Cookies) Gen(addr string) []byte {
+	return c.gen(addr, time.Now().Unix()/int64(CookieLifetime/time.Second))
+}
+
+// Check that cookie was generated for that remote address recently.
+func (c *Cookies) Valid(addr string, cookie []byte) bool {
+	if len(cookie) != CookieSize {
+		return false
+	}
+	period := time.Now().Unix() / int64(CookieLifetime/time.Second)
+	return bytes.Equal(cookie, c.gen(addr, period)) ||
+		bytes.Equal(cookie, c.gen(addr, period-1))
+}
+
+// Get cookie from the client's first handshake message. It is placed
+// right after client's DH public key.
+// R + ENC(H(DSAPub), R, El(CDHPub) + COOKIE) + IDtag
+func (h *Handshake) Cookie(data []byte) []byte {
+	if len(data) < RSize+32+CookieSize+8 {
+		return nil
+	}
+	if h.Conf.Encless {
+		out, err := EnclessDecode(h.dsaPubH, data[:RSize], data[RSize:len(data)-8])
+		if err != nil || len(out) < 32+CookieSize {
+			return nil
+		}
+		return out[32 : 32+CookieSize]
+	}
+	dec := make([]byte, 32+CookieSize)
+	salsa20.XORKeyStream(dec, data[RSize:RSize+32+CookieSize], data[:RSize], h.dsaPubH)
+	return dec[32:]
+}
+
+// Reply to client's first handshake message with the cookie, that it
+// has to include in the retried message. Handshake state must not be
+// used after that.
+// ENC(H(DSAPub), R+3, 0x00... + COOKIE) + IDtag
+func (h *Handshake) CookieSend(data []byte, cookie []byte) {
+	h.rNonce = new([RSize]byte)
+	copy(h.rNonce[:], data[:RSize])
+	var enc []byte
+	if h.Conf.Noise {
+		enc = make([]byte, h.Conf.MTU-8)
+	} else {
+		enc = make([]byte, cookieMarkerSize+CookieSize)
+	}
+	copy(enc[cookieMarkerSize:], cookie)
+	if h.Conf.Encless {
+		var err error
+		enc, err = EnclessEncode(h.dsaPubH, h.rNonceNext(3), enc)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		salsa20.XORKeyStream(enc, enc, h.rNonceNext(3), h.dsaPubH)
+	}
+	h.conn.Write(append(enc, idTag(h.Conf.Id, h.Conf.TimeSync, enc)...))
+}
+
+// Try to treat the message as server's cookie reply.
+func (h *Handshake) cookieFromMsg(data []byte) []byte {
+	var dec []byte
+	if h.Conf.Encless {
+		if len(data) != EnclessEnlargeSize+h.Conf.MTU {
+			return nil
+		}
+		var err error
+		dec, err = EnclessDecode(h.dsaPubH, h.rNonceNext(3), data[:len(data)-8])
+		if err != nil {
+			return nil
+		}
+	} else {
+		if len(data) < cookieMarkerSize+CookieSize+8 {
+			return nil
+		}
+		dec = make([]byte, cookieMarkerSize+CookieSize)
+		salsa20.XORKeyStream(dec, data[:cookieMarkerSize+CookieSize], h.rNonceNext(3), h.dsaPubH)
+	}
+	for i := 0; i < cookieMarkerSize; i++ {
+		if dec[i] != 0 {
+			return nil
+		}
+	}
+	return dec[cookieMarkerSize : cookieMarkerSize+CookieSize]
+}
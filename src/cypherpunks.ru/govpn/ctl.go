@@ -0,0 +1,126 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Control socket protocol is trivial: client connects to the Unix
+// domain socket, sends single line with the command and optional space
+// separated argument, and receives JSON encoded CtlResponse. Connection
+// is closed after that.
+
+// Control socket's response.
+type CtlResponse struct {
+	Ok    bool
+	Error string          `json:",omitempty"`
+	Data  json.RawMessage `json:",omitempty"`
+}
+
+// Control command handler. Returned data is serialized to JSON.
+type CtlHandler func(cmd, arg string) (interface{}, error)
+
+// Listen on control Unix domain socket. Stale socket file is removed
+// and new one is accessible only by the owner.
+func CtlListen(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// CtlProcessor is assumed to be run in background. It accepts
+// connections on control socket and processes requests with handler.
+func CtlProcessor(ln net.Listener, handler CtlHandler) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Error during accepting control connection", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go ctlServe(conn, handler)
+	}
+}
+
+func ctlServe(conn net.Conn, handler CtlHandler) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RWTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	cmdArg := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	var arg string
+	if len(cmdArg) == 2 {
+		arg = cmdArg[1]
+	}
+	resp := CtlResponse{Ok: true}
+	data, err := handler(cmdArg[0], arg)
+	if err == nil && data != nil {
+		resp.Data, err = json.Marshal(data)
+	}
+	if err != nil {
+		resp.Ok = false
+		resp.Error = err.Error()
+		resp.Data = nil
+	}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	conn.Write(append(raw, '\n'))
+}
+
+// Send command to the control socket and receive the response.
+func CtlRequest(path, cmd, arg string) (*CtlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, RWTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RWTimeout))
+	if strings.ContainsAny(cmd+arg, "\n") {
+		return nil, errors.New("Newline in control request")
+	}
+	if _, err = conn.Write([]byte(strings.TrimSpace(cmd+" "+arg) + "\n")); err != nil {
+		return nil, err
+	}
+	var resp CtlResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,60 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCtl(t *testing.T) {
+	dir := os.TempDir()
+	path := filepath.Join(dir, "govpn-ctl-test.sock")
+	ln, err := CtlListen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go CtlProcessor(ln, func(cmd, arg string) (interface{}, error) {
+		switch cmd {
+		case "echo":
+			return arg, nil
+		case "nothing":
+			return nil, nil
+		}
+		return nil, errors.New("unknown command")
+	})
+	resp, err := CtlRequest(path, "echo", "foo bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Ok || string(resp.Data) != `"foo bar"` {
+		t.Fatal(resp)
+	}
+	resp, err = CtlRequest(path, "nothing", "")
+	if err != nil || !resp.Ok || resp.Data != nil {
+		t.Fatal(resp, err)
+	}
+	resp, err = CtlRequest(path, "bad", "")
+	if err != nil || resp.Ok || resp.Error != "unknown command" {
+		t.Fatal(resp, err)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/binary"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	// Length-prefixed framing's prefix size
+	FrameLenSize = 2
+)
+
+// Length-prefixed framing of stream transports. Each packet is preceded
+// with its 16-bit big-endian length XORed with the ChaCha20 keystream.
+// Its key is derived from the session key, so the wire still looks
+// random, and separate nonces are used for each direction.
+type framer struct {
+	stream *chacha20.Cipher
+	// Length of the pending packet, if it is already decoded
+	size int
+}
+
+func newFramer(key *[SSize]byte, fromClient bool) *framer {
+	mac := blake2b.NewMAC(32, key[:])
+	mac.Write([]byte("FRAMING"))
+	framingKey := mac.Sum(nil)
+	nonce := make([]byte, chacha20.NonceSize)
+	if fromClient {
+		nonce[0] = 1
+	}
+	stream, err := chacha20.NewUnauthenticatedCipher(framingKey, nonce)
+	if err != nil {
+		panic(err)
+	}
+	SliceZero(framingKey)
+	return &framer{stream: stream, size: -1}
+}
+
+// Prepend the packet with obfuscated length.
+func (f *framer) frame(pkt []byte) []byte {
+	out := make([]byte, FrameLenSize, FrameLenSize+len(pkt))
+	binary.BigEndian.PutUint16(out, uint16(len(pkt)))
+	f.stream.XORKeyStream(out, out)
+	return append(out, pkt...)
+}
+
+// Get the next packet from the beginning of the stream's buffer. The
+// number of consumed bytes is returned, zero if packet is not received
+// completely yet, negative if its length exceeds the buffer.
+func (f *framer) next(buf []byte, bufSize int) ([]byte, int) {
+	if f.size == -1 {
+		if len(buf) < FrameLenSize {
+			return nil, 0
+		}
+		var size [FrameLenSize]byte
+		f.stream.XORKeyStream(size[:], buf[:FrameLenSize])
+		f.size = int(binary.BigEndian.Uint16(size[:]))
+	}
+	if FrameLenSize+f.size > bufSize {
+		return nil, -1
+	}
+	if len(buf) < FrameLenSize+f.size {
+		return nil, 0
+	}
+	pkt := buf[FrameLenSize : FrameLenSize+f.size]
+	f.size = -1
+	return pkt, FrameLenSize + len(pkt)
+}
+
+// Get the next packet from the stream's buffer with length-prefixed
+// framing. buf is the received data and bufSize is the whole buffer's
+// capacity. The number of consumed bytes is returned: zero if more
+// data is needed, negative if packet can not fit in the buffer.
+func (p *Peer) FrameNext(buf []byte, bufSize int) ([]byte, int) {
+	return p.framerR.next(buf, bufSize)
+}
@@ -0,0 +1,121 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFramingHandshake(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	conf := *testConf
+	conf.Framed = true
+	for _, noise := range []bool{false, true} {
+		conf.Noise = noise
+		hsS := NewHandshake("server", Dummy{&testCt}, &conf)
+		hsC := HandshakeStart("client", Dummy{&testCt}, &conf)
+		hsS.Server(testCt)
+		hsC.Client(testCt)
+		peerS := hsS.Server(testCt)
+		if peerS == nil || !peerS.Framed {
+			t.Fatal("server failed")
+		}
+		if len(testCt) != hsC.FinalSize() {
+			t.Fatal("final message size mismatch", len(testCt), hsC.FinalSize())
+		}
+		peerC := hsC.Client(testCt)
+		if peerC == nil || !peerC.Framed {
+			t.Fatal("client failed")
+		}
+	}
+}
+
+func TestFramingNotAllowed(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	confC := *testConf
+	confC.Framed = true
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, &confC)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if hsS.Server(testCt) != nil {
+		t.Fatal("framing is accepted")
+	}
+}
+
+func TestFramingStream(t *testing.T) {
+	conf := *testConf
+	conf.Framed = true
+	var stream bytes.Buffer
+	peerC := newPeer(true, "foo", &stream, &conf, new([SSize]byte))
+	peerS := newPeer(false, "foo", Dummy{nil}, &conf, new([SSize]byte))
+	sizes := make([]int, 0)
+	for i := 1; i < 100; i++ {
+		peerC.EthProcess(make([]byte, i*13))
+		sizes = append(sizes, i*13)
+	}
+	data := stream.Bytes()
+	if int(binary.BigEndian.Uint16(data)) == sizes[0]+1+TagSize+NonceSize {
+		t.Fatal("length is not obfuscated")
+	}
+	buf := make([]byte, 2*MTUDefault)
+	var prev, processed int
+	for len(data) > 0 {
+		// Feed the stream in small chunks
+		n := copy(buf[prev:], data[:7])
+		if len(data) < 7 {
+			n = copy(buf[prev:], data)
+		}
+		data = data[n:]
+		prev += n
+		for {
+			pkt, i := peerS.FrameNext(buf[:prev], len(buf))
+			if i < 0 {
+				t.Fatal("too big frame")
+			}
+			if i == 0 {
+				break
+			}
+			if !peerS.PktProcess(pkt, Dummy{nil}, false) {
+				t.Fatal("packet is not authenticated")
+			}
+			processed++
+			copy(buf, buf[i:prev])
+			prev -= i
+		}
+	}
+	if processed != len(sizes) || prev != 0 {
+		t.Fatal("not all packets processed", processed, prev)
+	}
+}
+
+func TestFramingTooBig(t *testing.T) {
+	f := newFramer(new([SSize]byte), true)
+	r := newFramer(new([SSize]byte), true)
+	framed := f.frame(make([]byte, 100))
+	if _, n := r.next(framed, 50); n >= 0 {
+		t.Fatal("too big frame is accepted")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+// Side going away notifies the remote one inside established transport,
+// so it does not have to wait for the timeout and tears the connection
+// down at once:
+//
+//     A -> B: GOODBYE(reason)
+//
+// It is not acknowledged, so it is sent several times in a row.
+
+const (
+	CtrlGoodbye = byte(0x08)
+
+	// How many times goodbye frame is sent
+	GoodbyeRepeat = 3
+)
+
+// Why the side is going away. Unknown reasons are accepted too.
+type GoodbyeReason byte
+
+const (
+	GoodbyeShutdown  GoodbyeReason = 0x01
+	GoodbyeReconnect GoodbyeReason = 0x02
+	GoodbyeKick      GoodbyeReason = 0x03
+	GoodbyeRevoke    GoodbyeReason = 0x04
+)
+
+func (r GoodbyeReason) String() string {
+	switch r {
+	case GoodbyeShutdown:
+		return "shutdown"
+	case GoodbyeReconnect:
+		return "reconnect"
+	case GoodbyeKick:
+		return "kick"
+	case GoodbyeRevoke:
+		return "revoke"
+	}
+	return "unknown"
+}
+
+// Tell the remote side that we are going away. Peer must not be zeroed
+// yet.
+func (p *Peer) Goodbye(reason GoodbyeReason) {
+	p.BusyT.Lock()
+	for i := 0; i < GoodbyeRepeat; i++ {
+		p.frameSend([]byte{CtrlGoodbye, byte(reason)}, CtrlPadByte)
+	}
+	p.BusyT.Unlock()
+}
+
+// Pass received goodbye to the handler once.
+func (p *Peer) goodbyeProcess(reason GoodbyeReason) {
+	p.BusyT.Lock()
+	handler := p.GoodbyeHandler
+	p.GoodbyeHandler = nil
+	p.BusyT.Unlock()
+	if handler != nil {
+		handler(reason)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+)
+
+func TestGoodbye(t *testing.T) {
+	var toC [][]byte
+	peerS := newPeer(false, "foo", testPipe{&toC}, testConf, new([SSize]byte))
+	peerC := newPeer(true, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	var goodbyes int
+	var reason GoodbyeReason
+	peerC.GoodbyeHandler = func(r GoodbyeReason) {
+		goodbyes++
+		reason = r
+	}
+	peerS.Goodbye(GoodbyeKick)
+	if len(toC) != GoodbyeRepeat {
+		t.Fatal("goodbye is not repeated", len(toC))
+	}
+	for len(toC) > 0 {
+		if !peerC.PktProcess(testPipePop(&toC), Dummy{nil}, true) {
+			t.Fatal("goodbye is not processed")
+		}
+	}
+	if goodbyes != 1 {
+		t.Fatal("goodbye handler is called", goodbyes, "times")
+	}
+	if reason != GoodbyeKick {
+		t.Fatal("wrong reason", reason)
+	}
+}
+
+func TestGoodbyeMalformed(t *testing.T) {
+	var ct []byte
+	peerS := newPeer(false, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerC := newPeer(true, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	peerC.GoodbyeHandler = func(GoodbyeReason) {
+		t.Fatal("malformed goodbye is accepted")
+	}
+	peerS.BusyT.Lock()
+	peerS.frameSend([]byte{CtrlGoodbye}, CtrlPadByte)
+	peerS.BusyT.Unlock()
+	if peerC.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("malformed goodbye is processed")
+	}
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/agl/ed25519"
 	"github.com/agl/ed25519/extra25519"
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
 	"github.com/dchest/blake2b"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/salsa20"
@@ -38,18 +39,21 @@ const (
 )
 
 type Handshake struct {
-	addr     string
-	conn     io.Writer
-	LastPing time.Time
-	Conf     *PeerConf
-	dsaPubH  *[ed25519.PublicKeySize]byte
-	key      *[32]byte
-	rNonce   *[RSize]byte
-	dhPriv   *[32]byte    // own private DH key
-	rServer  *[RSize]byte // random string for authentication
-	rClient  *[RSize]byte
-	sServer  *[SSize]byte // secret string for main key calculation
-	sClient  *[SSize]byte
+	addr      string
+	conn      io.Writer
+	LastPing  time.Time
+	Conf      *PeerConf
+	dsaPubH   *[ed25519.PublicKeySize]byte
+	key       *[32]byte
+	rNonce    *[RSize]byte
+	dhPriv    *[32]byte // own private DH key
+	dhPubRepr *[32]byte // own public DH key's representation
+	kemSeed   *[kyber768.KeySeedSize]byte
+	kemPub    []byte
+	rServer   *[RSize]byte // random string for authentication
+	rClient   *[RSize]byte
+	sServer   *[SSize]byte // secret string for main key calculation
+	sClient   *[SSize]byte
 }
 
 func keyFromSecrets(server, client []byte) *[SSize]byte {
@@ -68,6 +72,9 @@ func (h *Handshake) Zero() {
 	if h.dhPriv != nil {
 		SliceZero(h.dhPriv[:])
 	}
+	if h.kemSeed != nil {
+		SliceZero(h.kemSeed[:])
+	}
 	if h.key != nil {
 		SliceZero(h.key[:])
 	}
@@ -116,6 +123,81 @@ func dhKeyGen(priv, pub *[32]byte) *[32]byte {
 	return &hashed
 }
 
+// Handshake parameters are carried as bytes right after the handshake
+// message's fields: interface mode, transport's cipher suite, flags
+// (length-prefixed framing, Feistel network nonces) and 16-bit
+// big-endian MTU. Their default values are zero, so trailing default
+// parameters are never sent explicitly: either padding's zeros, or
+// absence of the bytes mean defaults. That keeps compatibility with
+// peers knowing nothing about them. Zero MTU means that it is not
+// negotiated. Unknown flags are ignored by the server and are not
+// echoed back to the client.
+type hsParams struct {
+	mode    Mode
+	suite   Suite
+	framed  bool
+	feistel bool
+	mtu     int
+}
+
+const (
+	hsFlagFramed  = 1 << 0
+	hsFlagFeistel = 1 << 1
+)
+
+func (p hsParams) size() int {
+	if p.mtu != 0 {
+		return 5
+	}
+	if p.framed || p.feistel {
+		return 3
+	}
+	if p.suite != SuiteSalsa20Poly1305 {
+		return 2
+	}
+	if p.mode != ModeTAP {
+		return 1
+	}
+	return 0
+}
+
+func (p hsParams) toMsg(msg []byte, offset int) {
+	size := p.size()
+	if size > 0 {
+		msg[offset] = byte(p.mode)
+	}
+	if size > 1 {
+		msg[offset+1] = byte(p.suite)
+	}
+	if p.framed {
+		msg[offset+2] |= hsFlagFramed
+	}
+	if p.feistel {
+		msg[offset+2] |= hsFlagFeistel
+	}
+	if size > 3 {
+		binary.BigEndian.PutUint16(msg[offset+3:], uint16(p.mtu))
+	}
+}
+
+func paramsFromMsg(msg []byte, offset int) hsParams {
+	p := hsParams{}
+	if len(msg) > offset {
+		p.mode = Mode(msg[offset])
+	}
+	if len(msg) > offset+1 {
+		p.suite = Suite(msg[offset+1])
+	}
+	if len(msg) > offset+2 {
+		p.framed = msg[offset+2]&hsFlagFramed != 0
+		p.feistel = msg[offset+2]&hsFlagFeistel != 0
+	}
+	if len(msg) > offset+4 {
+		p.mtu = int(binary.BigEndian.Uint16(msg[offset+3:]))
+	}
+	return p
+}
+
 // Create new handshake state.
 func NewHandshake(addr string, conn io.Writer, conf *PeerConf) *Handshake {
 	state := Handshake{
@@ -147,33 +229,49 @@ func idTag(id *PeerId, timeSync int, data []byte) []byte {
 // will be sent immediately.
 func HandshakeStart(addr string, conn io.Writer, conf *PeerConf) *Handshake {
 	state := NewHandshake(addr, conn, conf)
-	var dhPubRepr *[32]byte
-	state.dhPriv, dhPubRepr = dhKeypairGen()
+	state.dhPriv, state.dhPubRepr = dhKeypairGen()
+	if conf.Hybrid {
+		state.kemSeed, state.kemPub = kemKeypairGen()
+	}
+	state.start(nil)
+	return state
+}
 
-	state.rNonce = new([RSize]byte)
-	if _, err := io.ReadFull(Rand, state.rNonce[:]); err != nil {
+// Send the first handshake message with fresh R, optionally including
+// server's cookie. In hybrid mode KEM's public key follows the cookie,
+// which place is zeroed if there is no cookie.
+func (h *Handshake) start(cookie []byte) {
+	h.rNonce = new([RSize]byte)
+	if _, err := io.ReadFull(Rand, h.rNonce[:]); err != nil {
 		log.Fatalln("Error reading random for nonce:", err)
 	}
 	var enc []byte
-	if conf.Noise {
-		enc = make([]byte, conf.MTU-8-RSize)
+	if h.Conf.Noise {
+		enc = make([]byte, h.Conf.MTU-8-RSize)
+	} else if h.Conf.Hybrid {
+		enc = make([]byte, h.pubSizeClient())
+	} else if cookie != nil {
+		enc = make([]byte, 32+CookieSize)
 	} else {
 		enc = make([]byte, 32)
 	}
-	copy(enc, dhPubRepr[:])
-	if conf.Encless {
+	copy(enc, h.dhPubRepr[:])
+	copy(enc[32:], cookie)
+	if h.Conf.Hybrid {
+		copy(enc[32+CookieSize:], h.kemPub)
+	}
+	if h.Conf.Encless {
 		var err error
-		enc, err = EnclessEncode(state.dsaPubH, state.rNonce[:], enc)
-		if err != err {
+		enc, err = EnclessEncode(h.dsaPubH, h.rNonce[:], enc)
+		if err != nil {
 			panic(err)
 		}
 	} else {
-		salsa20.XORKeyStream(enc, enc, state.rNonce[:], state.dsaPubH)
+		salsa20.XORKeyStream(enc, enc, h.rNonce[:], h.dsaPubH)
 	}
-	data := append(state.rNonce[:], enc...)
-	data = append(data, idTag(state.Conf.Id, state.Conf.TimeSync, state.rNonce[:])...)
-	state.conn.Write(data)
-	return state
+	data := append(h.rNonce[:], enc...)
+	data = append(data, idTag(h.Conf.Id, h.Conf.TimeSync, h.rNonce[:])...)
+	h.conn.Write(data)
 }
 
 // Process handshake message on the server side.
@@ -182,28 +280,36 @@ func HandshakeStart(addr string, conn io.Writer, conf *PeerConf) *Handshake {
 // will be created and used as a transport. If no mutually
 // authenticated Peer is ready, then return nil.
 func (h *Handshake) Server(data []byte) *Peer {
-	// R + ENC(H(DSAPub), R, El(CDHPub)) + IDtag
+	// R + ENC(H(DSAPub), R, El(CDHPub) [+ COOKIE + KEMPub]) + IDtag
 	if h.rNonce == nil && ((!h.Conf.Encless && len(data) >= 48) ||
 		(h.Conf.Encless && len(data) == EnclessEnlargeSize+h.Conf.MTU)) {
+		pubSize := h.pubSizeClient()
+		if !h.Conf.Encless && len(data) < RSize+pubSize+8 {
+			log.Println("Too short handshake message from", h.addr)
+			return nil
+		}
 		h.rNonce = new([RSize]byte)
 		copy(h.rNonce[:], data[:RSize])
 
-		// Decrypt remote public key
-		cDHRepr := new([32]byte)
+		// Decrypt remote public keys
+		var decPub []byte
 		if h.Conf.Encless {
 			out, err := EnclessDecode(
 				h.dsaPubH,
 				h.rNonce[:],
 				data[RSize:len(data)-8],
 			)
-			if err != nil {
+			if err != nil || len(out) < pubSize {
 				log.Println("Unable to decode packet from", h.addr, err)
 				return nil
 			}
-			copy(cDHRepr[:], out)
+			decPub = out[:pubSize]
 		} else {
-			salsa20.XORKeyStream(cDHRepr[:], data[RSize:RSize+32], h.rNonce[:], h.dsaPubH)
+			decPub = make([]byte, pubSize)
+			salsa20.XORKeyStream(decPub, data[RSize:RSize+pubSize], h.rNonce[:], h.dsaPubH)
 		}
+		cDHRepr := new([32]byte)
+		copy(cDHRepr[:], decPub)
 
 		// Generate DH keypair
 		var dhPubRepr *[32]byte
@@ -214,18 +320,30 @@ func (h *Handshake) Server(data []byte) *Peer {
 		extra25519.RepresentativeToPublicKey(cDH, cDHRepr)
 		h.key = dhKeyGen(h.dhPriv, cDH)
 
+		// Encapsulate KEM's shared secret and mix it into the key
+		var kemCt []byte
+		if h.Conf.Hybrid {
+			var kemShared []byte
+			kemCt, kemShared = kemEncapsulate(decPub[32+CookieSize:])
+			h.key = kemKeyMix(h.key, kemShared)
+		}
+
 		var encPub []byte
 		var err error
 		if h.Conf.Encless {
 			encPub = make([]byte, h.Conf.MTU)
-			copy(encPub, dhPubRepr[:])
+		} else {
+			encPub = make([]byte, h.pubSizeServer())
+		}
+		copy(encPub, dhPubRepr[:])
+		copy(encPub[32:], kemCt)
+		if h.Conf.Encless {
 			encPub, err = EnclessEncode(h.dsaPubH, h.rNonceNext(1), encPub)
 			if err != nil {
 				panic(err)
 			}
 		} else {
-			encPub = make([]byte, 32)
-			salsa20.XORKeyStream(encPub, dhPubRepr[:], h.rNonceNext(1), h.dsaPubH)
+			salsa20.XORKeyStream(encPub, encPub, h.rNonceNext(1), h.dsaPubH)
 		}
 
 		// Generate R* and encrypt them
@@ -276,15 +394,9 @@ func (h *Handshake) Server(data []byte) *Peer {
 				log.Println("Unable to decode packet from", h.addr, err)
 				return nil
 			}
-			dec = dec[:RSize+RSize+SSize+ed25519.SignatureSize]
 		} else {
-			dec = make([]byte, RSize+RSize+SSize+ed25519.SignatureSize)
-			salsa20.XORKeyStream(
-				dec,
-				data[:RSize+RSize+SSize+ed25519.SignatureSize],
-				h.rNonceNext(1),
-				h.key,
-			)
+			dec = make([]byte, len(data)-8)
+			salsa20.XORKeyStream(dec, data[:len(data)-8], h.rNonceNext(1), h.key)
 		}
 		if subtle.ConstantTimeCompare(dec[:RSize], h.rServer[:]) != 1 {
 			log.Println("Invalid server's random number with", h.addr)
@@ -296,15 +408,40 @@ func (h *Handshake) Server(data []byte) *Peer {
 			log.Println("Invalid signature from", h.addr)
 			return nil
 		}
+		params := paramsFromMsg(dec, RSize+RSize+SSize+ed25519.SignatureSize)
+		if params.mode != h.Conf.Mode {
+			log.Println("Mode mismatch with", h.addr)
+			return nil
+		}
+		if !h.Conf.SuiteAllowed(params.suite) {
+			log.Println("Suite", params.suite, "is not allowed for", h.addr)
+			return nil
+		}
+		if params.framed && !h.Conf.Framed {
+			log.Println("Framing is not allowed for", h.addr)
+			return nil
+		}
+
+		// Effective MTU is the minimal one of both sides. Noised final
+		// answer is padded up to client's MTU, as it expects
+		mtuClient := h.Conf.MTU
+		if params.mtu != 0 {
+			mtuClient = params.mtu
+		}
+		params.mtu = h.Conf.MTU
+		if mtuClient < params.mtu {
+			params.mtu = mtuClient
+		}
 
 		// Send final answer to client
 		var enc []byte
 		if h.Conf.Noise {
-			enc = make([]byte, h.Conf.MTU-8)
+			enc = make([]byte, mtuClient-8)
 		} else {
-			enc = make([]byte, RSize)
+			enc = make([]byte, RSize+params.size())
 		}
 		copy(enc, dec[RSize:RSize+RSize])
+		params.toMsg(enc, RSize)
 		if h.Conf.Encless {
 			enc, err = EnclessEncode(h.key, h.rNonceNext(2), enc)
 			if err != nil {
@@ -316,11 +453,16 @@ func (h *Handshake) Server(data []byte) *Peer {
 		h.conn.Write(append(enc, idTag(h.Conf.Id, h.Conf.TimeSync, enc)...))
 
 		// Switch peer
+		conf := *h.Conf
+		conf.Suite = params.suite
+		conf.Framed = params.framed
+		conf.Feistel = params.feistel
+		conf.MTU = params.mtu
 		peer := newPeer(
 			false,
 			h.addr,
 			h.conn,
-			h.Conf,
+			&conf,
 			keyFromSecrets(h.sServer[:], dec[RSize+RSize:RSize+RSize+SSize]))
 		h.LastPing = time.Now()
 		return peer
@@ -330,18 +472,50 @@ func (h *Handshake) Server(data []byte) *Peer {
 	return nil
 }
 
+// Size of the server's final handshake message. Stream transports use
+// it to separate handshake from the following length-prefixed framed
+// packets.
+func (h *Handshake) FinalSize() int {
+	if h.Conf.Encless {
+		return EnclessEnlargeSize + h.Conf.MTU
+	}
+	if h.Conf.Noise {
+		return h.Conf.MTU
+	}
+	return RSize + h.params().size() + 8
+}
+
+// Parameters proposed by the client.
+func (h *Handshake) params() hsParams {
+	return hsParams{h.Conf.Mode, h.Conf.Suite, h.Conf.Framed, true, h.Conf.MTU}
+}
+
 // Process handshake message on the client side.
 // This function is intended to be called on client's side.
 // If this is the final handshake message, then new Peer object
 // will be created and used as a transport. If no mutually
 // authenticated Peer is ready, then return nil.
 func (h *Handshake) Client(data []byte) *Peer {
-	// ENC(H(DSAPub), R+1, El(SDHPub)) + ENC(K, R, RS + SS) + IDtag
+	// ENC(H(DSAPub), R+3, 0x00... + COOKIE) + IDtag
+	if h.rServer == nil && h.key == nil {
+		if cookie := h.cookieFromMsg(data); cookie != nil {
+			log.Println("Cookie received from", h.addr)
+			h.start(cookie)
+			h.LastPing = time.Now()
+			return nil
+		}
+	}
+	// ENC(H(DSAPub), R+1, El(SDHPub) [+ KEMCt]) + ENC(K, R, RS + SS) + IDtag
 	if h.rServer == nil && h.key == nil &&
 		((!h.Conf.Encless && len(data) >= 80) ||
 			(h.Conf.Encless && len(data) == 2*(EnclessEnlargeSize+h.Conf.MTU))) {
-		// Decrypt remote public key
-		sDHRepr := new([32]byte)
+		pubSize := h.pubSizeServer()
+		if !h.Conf.Encless && len(data) < pubSize+RSize+SSize+8 {
+			log.Println("Too short handshake message from", h.addr)
+			return nil
+		}
+		// Decrypt remote public key and KEM's ciphertext
+		var decPub []byte
 		var tmp []byte
 		var err error
 		if h.Conf.Encless {
@@ -350,19 +524,25 @@ func (h *Handshake) Client(data []byte) *Peer {
 				h.rNonceNext(1),
 				data[:len(data)/2],
 			)
-			if err != nil {
+			if err != nil || len(tmp) < pubSize {
 				log.Println("Unable to decode packet from", h.addr, err)
 				return nil
 			}
-			copy(sDHRepr[:], tmp[:32])
+			decPub = tmp[:pubSize]
 		} else {
-			salsa20.XORKeyStream(sDHRepr[:], data[:32], h.rNonceNext(1), h.dsaPubH)
+			decPub = make([]byte, pubSize)
+			salsa20.XORKeyStream(decPub, data[:pubSize], h.rNonceNext(1), h.dsaPubH)
 		}
+		sDHRepr := new([32]byte)
+		copy(sDHRepr[:], decPub)
 
 		// Compute shared key
 		sDH := new([32]byte)
 		extra25519.RepresentativeToPublicKey(sDH, sDHRepr)
 		h.key = dhKeyGen(h.dhPriv, sDH)
+		if h.Conf.Hybrid {
+			h.key = kemKeyMix(h.key, kemDecapsulate(h.kemSeed, decPub[32:]))
+		}
 
 		// Decrypt Rs
 		h.rServer = new([RSize]byte)
@@ -381,7 +561,7 @@ func (h *Handshake) Client(data []byte) *Peer {
 			copy(h.sServer[:], tmp[RSize:RSize+SSize])
 		} else {
 			decRs := make([]byte, RSize+SSize)
-			salsa20.XORKeyStream(decRs, data[SSize:SSize+RSize+SSize], h.rNonce[:], h.key)
+			salsa20.XORKeyStream(decRs, data[pubSize:pubSize+RSize+SSize], h.rNonce[:], h.key)
 			copy(h.rServer[:], decRs[:RSize])
 			copy(h.sServer[:], decRs[RSize:])
 		}
@@ -397,16 +577,18 @@ func (h *Handshake) Client(data []byte) *Peer {
 		}
 		sign := ed25519.Sign(h.Conf.DSAPriv, h.key[:])
 
+		params := h.params()
 		var enc []byte
 		if h.Conf.Noise {
 			enc = make([]byte, h.Conf.MTU-8)
 		} else {
-			enc = make([]byte, RSize+RSize+SSize+ed25519.SignatureSize)
+			enc = make([]byte, RSize+RSize+SSize+ed25519.SignatureSize+params.size())
 		}
 		copy(enc, h.rServer[:])
 		copy(enc[RSize:], h.rClient[:])
 		copy(enc[RSize+RSize:], h.sClient[:])
 		copy(enc[RSize+RSize+SSize:], sign[:])
+		params.toMsg(enc, RSize+RSize+SSize+ed25519.SignatureSize)
 		if h.Conf.Encless {
 			enc, err = EnclessEncode(h.key, h.rNonceNext(1), enc)
 			if err != nil {
@@ -432,22 +614,44 @@ func (h *Handshake) Client(data []byte) *Peer {
 				log.Println("Unable to decode packet from", h.addr, err)
 				return nil
 			}
-			dec = dec[:RSize]
 		} else {
-			dec = make([]byte, RSize)
-			salsa20.XORKeyStream(dec, data[:RSize], h.rNonceNext(2), h.key)
+			dec = make([]byte, len(data)-8)
+			salsa20.XORKeyStream(dec, data[:len(data)-8], h.rNonceNext(2), h.key)
 		}
-		if subtle.ConstantTimeCompare(dec, h.rClient[:]) != 1 {
+		if subtle.ConstantTimeCompare(dec[:RSize], h.rClient[:]) != 1 {
 			log.Println("Invalid client's random number with", h.addr)
 			return nil
 		}
+		params := paramsFromMsg(dec, RSize)
+		if params.mode != h.Conf.Mode {
+			log.Println("Mode mismatch with", h.addr)
+			return nil
+		}
+		if params.suite != h.Conf.Suite {
+			log.Println("Suite mismatch with", h.addr)
+			return nil
+		}
+		if params.framed != h.Conf.Framed {
+			log.Println("Framing mismatch with", h.addr)
+			return nil
+		}
+		if params.mtu > h.Conf.MTU {
+			log.Println("MTU", params.mtu, "is bigger than ours with", h.addr)
+			return nil
+		}
 
-		// Switch peer
+		// Switch peer. Older server does not echo Feistel network's
+		// flag, so legacy nonces are used with it
+		conf := *h.Conf
+		conf.Feistel = params.feistel
+		if params.mtu != 0 {
+			conf.MTU = params.mtu
+		}
 		peer := newPeer(
 			true,
 			h.addr,
 			h.conn,
-			h.Conf,
+			&conf,
 			keyFromSecrets(h.sServer[:], h.sClient[:]),
 		)
 		h.LastPing = time.Now()
@@ -77,3 +77,116 @@ func TestHandshakeEnclessSymmetric(t *testing.T) {
 	testConf.Encless = false
 	testConf.Noise = false
 }
+
+func TestHandshakeTUNSymmetric(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	testConf.Mode = ModeTUN
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if hsS.Server(testCt) == nil {
+		t.Fail()
+	}
+	if hsC.Client(testCt) == nil {
+		t.Fail()
+	}
+	testConf.Mode = ModeTAP
+}
+
+func TestHandshakeModeMismatch(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	confC := *testConf
+	confC.Mode = ModeTUN
+	for _, noise := range []bool{false, true} {
+		testConf.Noise = noise
+		confC.Noise = noise
+		hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+		hsC := HandshakeStart("client", Dummy{&testCt}, &confC)
+		hsS.Server(testCt)
+		hsC.Client(testCt)
+		if hsS.Server(testCt) != nil {
+			t.Fail()
+		}
+	}
+	testConf.Noise = false
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	cookies := NewCookies()
+	for _, noise := range []bool{false, true} {
+		testConf.Noise = noise
+		hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+		hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+		if cookies.Valid("client", hsS.Cookie(testCt)) {
+			t.Fatal("cookie is valid without server's reply")
+		}
+		hsS.CookieSend(testCt, cookies.Gen("client"))
+		if hsC.Client(testCt) != nil {
+			t.Fatal("peer created on cookie reply")
+		}
+		hsS = NewHandshake("server", Dummy{&testCt}, testConf)
+		if !cookies.Valid("client", hsS.Cookie(testCt)) {
+			t.Fatal("cookie is not accepted")
+		}
+		if cookies.Valid("another", hsS.Cookie(testCt)) {
+			t.Fatal("cookie is accepted from another address")
+		}
+		hsS.Server(testCt)
+		hsC.Client(testCt)
+		if hsS.Server(testCt) == nil {
+			t.Fatal("server failed")
+		}
+		if hsC.Client(testCt) == nil {
+			t.Fatal("client failed")
+		}
+	}
+	testConf.Noise = false
+}
+
+func TestHandshakeFeistel(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	peerS := hsS.Server(testCt)
+	peerC := hsC.Client(testCt)
+	if peerS == nil || peerC == nil {
+		t.Fatal("handshake failed")
+	}
+	if !peerS.Feistel || !peerC.Feistel {
+		t.Fatal("Feistel network is not negotiated")
+	}
+}
+
+// Older peers neither send nor echo Feistel network's flag.
+func TestHandshakeParamsFeistel(t *testing.T) {
+	msg := make([]byte, 3)
+	hsParams{framed: true}.toMsg(msg, 0)
+	if p := paramsFromMsg(msg, 0); !p.framed || p.feistel {
+		t.Fatal("legacy", p)
+	}
+	p := hsParams{framed: true, feistel: true}
+	msg = make([]byte, p.size())
+	p.toMsg(msg, 0)
+	if p = paramsFromMsg(msg, 0); !p.framed || !p.feistel {
+		t.Fatal("Feistel", p)
+	}
+	if p = paramsFromMsg(msg[:2], 0); p.feistel {
+		t.Fatal("absent flags", p)
+	}
+}
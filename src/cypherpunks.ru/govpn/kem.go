@@ -0,0 +1,104 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"io"
+	"log"
+
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+	"github.com/dchest/blake2b"
+)
+
+const (
+	KEMPubSize        = kyber768.PublicKeySize
+	KEMCiphertextSize = kyber768.CiphertextSize
+	// Minimal MTU, allowing client's KEM public key to fit in the
+	// noised or encless first handshake message
+	KEMMTUMin = RSize + 32 + CookieSize + KEMPubSize + 8
+)
+
+// Generate ephemeral Kyber768 keypair for the hybrid handshake. Only
+// the seed is kept instead of the private key: it is a plain array
+// that can be zeroed. Public key is returned packed.
+func kemKeypairGen() (*[kyber768.KeySeedSize]byte, []byte) {
+	seed := new([kyber768.KeySeedSize]byte)
+	if _, err := io.ReadFull(Rand, seed[:]); err != nil {
+		log.Fatalln("Error reading random for KEM private key:", err)
+	}
+	pub, _ := kyber768.NewKeyFromSeed(seed[:])
+	pubRaw := make([]byte, KEMPubSize)
+	pub.Pack(pubRaw)
+	return seed, pubRaw
+}
+
+// Encapsulate shared secret to remote side's packed public key.
+func kemEncapsulate(pubRaw []byte) (ct, shared []byte) {
+	pub := new(kyber768.PublicKey)
+	pub.Unpack(pubRaw)
+	seed := make([]byte, kyber768.EncapsulationSeedSize)
+	if _, err := io.ReadFull(Rand, seed); err != nil {
+		log.Fatalln("Error reading random for KEM encapsulation:", err)
+	}
+	ct = make([]byte, KEMCiphertextSize)
+	shared = make([]byte, kyber768.SharedKeySize)
+	pub.EncapsulateTo(ct, shared, seed)
+	SliceZero(seed)
+	return ct, shared
+}
+
+// Decapsulate shared secret with the private key derived from the
+// seed. Expanded private key lives in the library's own structures, so
+// it is not zeroed: it is just left for the garbage collector.
+func kemDecapsulate(seed *[kyber768.KeySeedSize]byte, ct []byte) []byte {
+	_, priv := kyber768.NewKeyFromSeed(seed[:])
+	shared := make([]byte, kyber768.SharedKeySize)
+	priv.DecapsulateTo(shared, ct)
+	return shared
+}
+
+// Mix KEM's shared secret into the DH derived key. Resulting key is
+// secure as long as either of them is.
+func kemKeyMix(key *[32]byte, shared []byte) *[32]byte {
+	mac := blake2b.NewMAC(32, key[:])
+	mac.Write(shared)
+	mixed := new([32]byte)
+	mac.Sum(mixed[:0])
+	SliceZero(key[:])
+	SliceZero(shared)
+	return mixed
+}
+
+// Size of client's public keys part in the first handshake message.
+// KEM's public key follows the cookie's place.
+func (h *Handshake) pubSizeClient() int {
+	if h.Conf.Hybrid {
+		return 32 + CookieSize + KEMPubSize
+	}
+	return 32
+}
+
+// Size of server's public key and KEM ciphertext part in the second
+// handshake message.
+func (h *Handshake) pubSizeServer() int {
+	if h.Conf.Hybrid {
+		return 32 + KEMCiphertextSize
+	}
+	return 32
+}
@@ -0,0 +1,91 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+)
+
+func TestHandshakeHybridSymmetric(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	testConf.Hybrid = true
+	for _, c := range []struct{ noise, encless bool }{
+		{false, false},
+		{true, false},
+		{true, true},
+	} {
+		testConf.Noise = c.noise
+		testConf.Encless = c.encless
+		hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+		hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+		hsS.Server(testCt)
+		hsC.Client(testCt)
+		peerS := hsS.Server(testCt)
+		if peerS == nil {
+			t.Fatal("server failed", c)
+		}
+		peerC := hsC.Client(testCt)
+		if peerC == nil {
+			t.Fatal("client failed", c)
+		}
+		if bytes.Compare(peerS.key[:], peerC.key[:]) != 0 {
+			t.Fatal("keys differ", c)
+		}
+	}
+	testConf.Hybrid = false
+	testConf.Noise = false
+	testConf.Encless = false
+}
+
+func TestHandshakeHybridMismatch(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	confS := *testConf
+	testConf.Hybrid = true
+	hsS := NewHandshake("server", Dummy{&testCt}, &confS)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if hsS.Server(testCt) != nil {
+		t.Fail()
+	}
+	testConf.Hybrid = false
+}
+
+func TestKEMSeedZero(t *testing.T) {
+	testConf.Hybrid = true
+	defer func() { testConf.Hybrid = false }()
+	hs := HandshakeStart("client", Dummy{&testCt}, testConf)
+	seed := hs.kemSeed
+	if *seed == ([kyber768.KeySeedSize]byte{}) {
+		t.Fatal("no KEM seed")
+	}
+	hs.Zero()
+	if *seed != ([kyber768.KeySeedSize]byte{}) {
+		t.Fatal("KEM seed is not zeroed")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Metrics are exported in Prometheus text exposition format.
+
+const MetricsContentType = "text/plain; version=0.0.4"
+
+// Source of additional metrics, written after the peers' ones.
+type MetricsWriter interface {
+	MetricsWrite(w io.Writer)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format metric's labels from the name and value pairs.
+func MetricLabels(nameValues ...string) string {
+	labels := make([]string, 0, len(nameValues)/2)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		labels = append(labels, fmt.Sprintf(
+			`%s="%s"`, nameValues[i], metricLabelEscaper.Replace(nameValues[i+1]),
+		))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func MetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func MetricSample(w io.Writer, name, labels string, value interface{}) {
+	fmt.Fprintf(w, "%s%s %v\n", name, labels, value)
+}
+
+// Write single unlabelled metric.
+func MetricWrite(w io.Writer, name, typ, help string, value interface{}) {
+	MetricHeader(w, name, typ, help)
+	MetricSample(w, name, "", value)
+}
+
+var peerMetrics = []struct {
+	name  string
+	help  string
+	value func(*Peer) *uint64
+}{
+	{"bytes_in", "Bytes received", func(p *Peer) *uint64 { return &p.BytesIn }},
+	{"bytes_out", "Bytes sent", func(p *Peer) *uint64 { return &p.BytesOut }},
+	{"bytes_payload_in", "Payload bytes received", func(p *Peer) *uint64 { return &p.BytesPayloadIn }},
+	{"bytes_payload_out", "Payload bytes sent", func(p *Peer) *uint64 { return &p.BytesPayloadOut }},
+	{"frames_in", "Frames received", func(p *Peer) *uint64 { return &p.FramesIn }},
+	{"frames_out", "Frames sent", func(p *Peer) *uint64 { return &p.FramesOut }},
+	{"frames_unauth", "Unauthenticated frames received", func(p *Peer) *uint64 { return &p.FramesUnauth }},
+	{"frames_dup", "Duplicate frames received", func(p *Peer) *uint64 { return &p.FramesDup }},
+	{"frames_oversized", "Frames bigger than MTU dropped", func(p *Peer) *uint64 { return &p.FramesOversized }},
+	{"heartbeat_recv", "Heartbeats received", func(p *Peer) *uint64 { return &p.HeartbeatRecv }},
+	{"heartbeat_sent", "Heartbeats sent", func(p *Peer) *uint64 { return &p.HeartbeatSent }},
+	{"rekeys", "In-band rekeyings made", func(p *Peer) *uint64 { return &p.Rekeys }},
+	{"roams", "Remote address changes", func(p *Peer) *uint64 { return &p.Roams }},
+}
+
+// Write peers' counters, labelled by peer's name and identity.
+func PeersMetricsWrite(w io.Writer, peers []*Peer) {
+	labels := make([]string, len(peers))
+	for i, peer := range peers {
+		labels[i] = MetricLabels("name", peer.Name, "id", peer.Id.String())
+	}
+	for _, m := range peerMetrics {
+		name := "govpn_peer_" + m.name + "_total"
+		MetricHeader(w, name, "counter", m.help)
+		for i, peer := range peers {
+			MetricSample(w, name, labels[i], atomic.LoadUint64(m.value(peer)))
+		}
+	}
+	MetricHeader(w, "govpn_peer_pmtu", "gauge", "Discovered path MTU")
+	for i, peer := range peers {
+		peer.BusyT.Lock()
+		pmtu := peer.PMTU
+		peer.BusyT.Unlock()
+		MetricSample(w, "govpn_peer_pmtu", labels[i], pmtu)
+	}
+}
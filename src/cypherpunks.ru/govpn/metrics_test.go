@@ -0,0 +1,52 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricLabelsEscape(t *testing.T) {
+	got := MetricLabels("name", "a\"b\\c\nd", "id", "x")
+	if got != `{name="a\"b\\c\nd",id="x"}` {
+		t.Fatal("bad labels:", got)
+	}
+}
+
+func TestPeersMetrics(t *testing.T) {
+	peer := newPeer(true, "foo", Dummy{&testCt}, testConf, new([SSize]byte))
+	peer.Name = "alice"
+	peer.BytesIn = 123
+	peer.FramesDup = 2
+	var buf bytes.Buffer
+	PeersMetricsWrite(&buf, []*Peer{peer})
+	labels := MetricLabels("name", "alice", "id", peer.Id.String())
+	for _, line := range []string{
+		"# TYPE govpn_peer_bytes_in_total counter",
+		"govpn_peer_bytes_in_total" + labels + " 123",
+		"govpn_peer_frames_dup_total" + labels + " 2",
+		"govpn_peer_heartbeat_sent_total" + labels + " 0",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatal("missing:", line)
+		}
+	}
+}
@@ -19,9 +19,10 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
-	"bytes"
+	"crypto/cipher"
 	"crypto/subtle"
 	"encoding/binary"
+	"hash"
 	"io"
 	"log"
 	"sync"
@@ -34,9 +35,8 @@ import (
 )
 
 const (
-	NonceSize       = 8
-	NonceBucketSize = 256
-	TagSize         = poly1305.TagSize
+	NonceSize = 8
+	TagSize   = poly1305.TagSize
 	// S20BS is Salsa20's internal blocksize in bytes
 	S20BS = 64
 	// Maximal amount of bytes transfered with single key (4 GiB)
@@ -47,25 +47,205 @@ const (
 	MinPktLength = 1 + 16 + 8
 	// Padding byte
 	PadByte = byte(0x80)
+	// Padding byte of control frames
+	CtrlPadByte = byte(0x40)
 )
 
-func newNonces(key *[32]byte, i uint64) chan *[NonceSize]byte {
+// Check that TUN payload looks like either IPv4 or IPv6 packet.
+func ipPktValid(pkt []byte) bool {
+	switch pkt[0] >> 4 {
+	case 4, 6:
+		return true
+	}
+	return false
+}
+
+// Nonces generator: nonce is the counter encrypted with four rounds
+// Feistel network, with BLAKE2b-MAC as the round function, keyed with
+// the value derived from the session key. So it can be decrypted back
+// to the counter. Peers not negotiated Feistel network use legacy
+// nonces: BLAKE2b-MAC of the counter itself, that can not be
+// decrypted. It is computed on demand, so it must be guarded by the
+// caller.
+type nonceGen struct {
+	key     []byte
+	mac     hash.Hash
+	feistel bool
+	in      [1 + 4]byte
+	sum     [NonceSize]byte
+}
+
+func newNonceGen(key *[32]byte, feistel bool) *nonceGen {
 	macKey := make([]byte, 32)
 	salsa20.XORKeyStream(macKey, make([]byte, 32), make([]byte, 8), key)
-	mac := blake2b.NewMAC(NonceSize, macKey)
-	nonces := make(chan *[NonceSize]byte, NonceBucketSize*3)
-	go func() {
-		for {
-			buf := new([NonceSize]byte)
-			binary.BigEndian.PutUint64(buf[:], i)
-			mac.Write(buf[:])
-			mac.Sum(buf[:0])
-			nonces <- buf
-			mac.Reset()
-			i += 2
+	g := nonceGen{
+		key:     macKey,
+		mac:     blake2b.NewMAC(NonceSize, macKey),
+		feistel: feistel,
+	}
+	return &g
+}
+
+func (g *nonceGen) round(i byte, half uint32) uint32 {
+	g.in[0] = i
+	binary.BigEndian.PutUint32(g.in[1:], half)
+	g.mac.Write(g.in[:])
+	g.mac.Sum(g.sum[:0])
+	g.mac.Reset()
+	return binary.BigEndian.Uint32(g.sum[:4])
+}
+
+// Compute nonce with the given counter value.
+func (g *nonceGen) nonce(i uint64, dst *[NonceSize]byte) {
+	if !g.feistel {
+		binary.BigEndian.PutUint64(g.sum[:], i)
+		g.mac.Write(g.sum[:])
+		g.mac.Sum(g.sum[:0])
+		g.mac.Reset()
+		*dst = g.sum
+		return
+	}
+	l, r := uint32(i>>32), uint32(i)
+	for n := byte(0); n < 4; n++ {
+		l, r = r, l^g.round(n, r)
+	}
+	binary.BigEndian.PutUint32(dst[:4], l)
+	binary.BigEndian.PutUint32(dst[4:], r)
+}
+
+// Decrypt nonce back to the counter value. Only Feistel network's
+// nonces can be decrypted.
+func (g *nonceGen) counter(nonce *[NonceSize]byte) uint64 {
+	l := binary.BigEndian.Uint32(nonce[:4])
+	r := binary.BigEndian.Uint32(nonce[4:])
+	for n := byte(4); n > 0; n-- {
+		l, r = r^g.round(n-1, l), l
+	}
+	return uint64(l)<<32 | uint64(r)
+}
+
+// Forget the key. Generated nonces are useless after that.
+func (g *nonceGen) zero() {
+	SliceZero(g.key)
+	g.mac = blake2b.NewMAC(NonceSize, g.key)
+}
+
+// Initial nonce counters for both directions. They differ by parity,
+// so client and server never use the same nonce with the same key.
+func nonceStarts(isClient bool) (uint64, uint64) {
+	if isClient {
+		return 1 + 2, 0 + 2
+	}
+	return 0 + 2, 1 + 2
+}
+
+// Receiving side state bound to the single key. Peer can have two of
+// them at once during rekeying.
+type peerRx struct {
+	key    *[SSize]byte
+	aead   cipher.AEAD
+	nonces *nonceGen
+	parity uint64
+
+	// UDP-related
+	replay *replayWindow
+	// Legacy nonces of the serial numbers from the replay window up to
+	// the window's size ahead of it, mapped to their serials
+	legacy     map[[NonceSize]byte]uint64
+	legacyNext uint64
+	legacyOld  uint64
+
+	// TCP-related
+	nonceExpect     []byte
+	nonceExpectNext uint64
+}
+
+func newPeerRx(key *[SSize]byte, suite Suite, isClient, feistel bool, window int) *peerRx {
+	_, nonceStart := nonceStarts(isClient)
+	rx := peerRx{
+		key:             key,
+		aead:            suite.newAEAD(key),
+		nonces:          newNonceGen(key, feistel),
+		parity:          nonceStart % 2,
+		replay:          newReplayWindow(window),
+		nonceExpect:     make([]byte, NonceSize),
+		nonceExpectNext: nonceStart,
+	}
+	rx.nonceExpectAdvance()
+	if !feistel {
+		rx.legacy = make(map[[NonceSize]byte]uint64)
+		rx.legacyNext = nonceStart / 2
+		rx.legacyOld = rx.legacyNext
+		rx.legacyFill()
+	}
+	return &rx
+}
+
+// Keep legacy nonces map in sync with the replay window: add the
+// serials ahead of it and forget the ones that became too old.
+func (rx *peerRx) legacyFill() {
+	var nonce [NonceSize]byte
+	for ; rx.legacyNext <= rx.replay.top+rx.replay.size; rx.legacyNext++ {
+		rx.nonces.nonce(rx.legacyNext*2+rx.parity, &nonce)
+		rx.legacy[nonce] = rx.legacyNext
+	}
+	for ; rx.legacyOld+rx.replay.size <= rx.replay.top; rx.legacyOld++ {
+		rx.nonces.nonce(rx.legacyOld*2+rx.parity, &nonce)
+		delete(rx.legacy, nonce)
+	}
+}
+
+// Get the counter the received nonce was generated from. Legacy nonces
+// are looked up only among the expected ones.
+func (rx *peerRx) counter(nonce *[NonceSize]byte) (uint64, bool) {
+	if rx.legacy == nil {
+		return rx.nonces.counter(nonce), true
+	}
+	serial, exists := rx.legacy[*nonce]
+	return serial*2 + rx.parity, exists
+}
+
+// Generate the next expected nonce of the stream transport.
+func (rx *peerRx) nonceExpectAdvance() {
+	var nonce [NonceSize]byte
+	rx.nonces.nonce(rx.nonceExpectNext, &nonce)
+	rx.nonceExpectNext += 2
+	copy(rx.nonceExpect, nonce[:])
+}
+
+// Forget the key and all nonces state.
+func (rx *peerRx) zero() {
+	SliceZero(rx.key[:])
+	rx.aead = nil
+	rx.nonces.zero()
+	if rx.legacy != nil {
+		rx.legacy = make(map[[NonceSize]byte]uint64)
+	}
+	SliceZero(rx.nonceExpect)
+}
+
+// Check that nonce was not seen before and remember it.
+func (rx *peerRx) nonceCheck(nonceRecv *[NonceSize]byte, reorderable bool) bool {
+	if !reorderable {
+		if subtle.ConstantTimeCompare(nonceRecv[:], rx.nonceExpect) != 1 {
+			return false
 		}
-	}()
-	return nonces
+		rx.nonceExpectAdvance()
+		return true
+	}
+	i, known := rx.counter(nonceRecv)
+	// Counters of the opposite direction, including reflected our
+	// own packets, are never accepted
+	if !known || i%2 != rx.parity {
+		return false
+	}
+	if !rx.replay.check(i / 2) {
+		return false
+	}
+	if rx.legacy != nil {
+		rx.legacyFill()
+	}
+	return true
 }
 
 type Peer struct {
@@ -78,12 +258,18 @@ type Peer struct {
 	FramesOut       uint64
 	FramesUnauth    uint64
 	FramesDup       uint64
+	FramesOversized uint64
 	HeartbeatRecv   uint64
 	HeartbeatSent   uint64
+	Rekeys          uint64
+	Roams           uint64
+	// BytesIn+BytesOut value when the current key was installed
+	bytesKey uint64
 
 	// Basic
 	Addr string
 	Id   *PeerId
+	Name string
 	Conn io.Writer `json:"-"`
 
 	// Traffic behaviour
@@ -92,58 +278,121 @@ type Peer struct {
 	CPRCycle    time.Duration `json:"-"`
 	Encless     bool
 	MTU         int
+	Mode        Mode
+	Suite       Suite
+	// Nonces are made with Feistel network, negotiated by handshake
+	Feistel bool
 
-	key *[SSize]byte `json:"-"`
+	key      *[SSize]byte `json:"-"`
+	isClient bool
 
 	// Timers
 	Timeout     time.Duration `json:"-"`
 	Established time.Time
 	LastPing    time.Time
+	Rekeyed     time.Time
 
 	// Receiver
-	BusyR    sync.Mutex `json:"-"`
-	bufR     []byte
-	tagR     *[TagSize]byte
-	keyAuthR *[SSize]byte
-	pktSizeR int
-
-	// UDP-related
-	noncesR      chan *[NonceSize]byte
+	BusyR        sync.Mutex `json:"-"`
+	bufR         []byte
+	nonceR       []byte
+	pktSizeR     int
+	ReplayWindow int
+
+	// Receiving state of the current key and either the previous one,
+	// or the next one during the rekeying
+	rx           *peerRx
+	rxAlt        *peerRx
+	rxAltPending bool
+	rxAltExpire  time.Time
 	nonceRecv    [NonceSize]byte
-	nonceBucketL map[[NonceSize]byte]struct{}
-	nonceBucketM map[[NonceSize]byte]struct{}
-	nonceBucketH map[[NonceSize]byte]struct{}
 
 	// TCP-related
-	NonceExpect  []byte `json:"-"`
-	noncesExpect chan *[NonceSize]byte
+	NonceExpect []byte `json:"-"`
+	Framed      bool
+	framerR     *framer
+	framerT     *framer
 
 	// Transmitter
-	BusyT    sync.Mutex `json:"-"`
-	bufT     []byte
-	tagT     *[TagSize]byte
-	keyAuthT *[SSize]byte
-	frameT   []byte
-	noncesT  chan *[NonceSize]byte
+	BusyT      sync.Mutex `json:"-"`
+	bufT       []byte
+	outT       []byte
+	aeadT      cipher.AEAD
+	nonceT     []byte
+	noncesT    *nonceGen
+	nonceNextT uint64
+	// Burst of frames collected for batched sending, guarded by BusyT
+	batchT   [][]byte
+	batchN   int
+	batching bool
+
+	// Rekeying, guarded by BusyT
+	Rekey        time.Duration `json:"-"`
+	rekeyPriv    *[32]byte
+	rekeyPub     *[32]byte
+	rekeyStarted time.Time
+	keyNext      *[SSize]byte
+
+	// Configuration push, guarded by BusyT
+	pushData []byte
+	pushSent time.Time
+	// Called once when pushed configuration is received
+	PushHandler func(*PushConf) `json:"-"`
+
+	// Path MTU discovery, guarded by BusyT
+	PMTUDiscovery bool `json:"-"`
+	PMTU          int
+	mtuMax        int
+	pmtuSent      time.Time
+	pmtuRound     bool
+	pmtuBest      int
+	// Called with the new MTU when it is changed by discovery
+	MTUHandler func(int) `json:"-"`
+
+	// Goodbye, guarded by BusyT
+	// Called once with the reason when remote side says goodbye
+	GoodbyeHandler func(GoodbyeReason) `json:"-"`
 }
 
 func (p *Peer) String() string {
 	return p.Id.String() + ":" + p.Addr
 }
 
-// Zero peer's memory state.
+// Zero peer's memory state: keys, nonces generators and buffers.
 func (p *Peer) Zero() {
 	p.BusyT.Lock()
 	p.BusyR.Lock()
 	SliceZero(p.key[:])
+	p.aeadT = nil
+	p.noncesT.zero()
+	p.rx.zero()
+	if p.rxAlt != nil {
+		p.rxAlt.zero()
+		p.rxAlt = nil
+	}
+	if p.rekeyPriv != nil {
+		SliceZero(p.rekeyPriv[:])
+		p.rekeyPriv = nil
+	}
+	if p.keyNext != nil {
+		SliceZero(p.keyNext[:])
+		p.keyNext = nil
+	}
+	p.pushData = nil
+	p.batchT = nil
 	SliceZero(p.bufR)
 	SliceZero(p.bufT)
-	SliceZero(p.keyAuthR[:])
-	SliceZero(p.keyAuthT[:])
+	SliceZero(p.outT)
 	p.BusyT.Unlock()
 	p.BusyR.Unlock()
 }
 
+// Amount of bytes transferred with the current key.
+func (p *Peer) KeyBytes() uint64 {
+	return atomic.LoadUint64(&p.BytesIn) + atomic.LoadUint64(&p.BytesOut) -
+		atomic.LoadUint64(&p.bytesKey)
+}
+
 func cprCycleCalculate(conf *PeerConf) time.Duration {
 	if conf.CPR == 0 {
 		return time.Duration(0)
@@ -179,6 +428,7 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 	peer := Peer{
 		Addr: addr,
 		Id:   conf.Id,
+		Name: conf.Name,
 		Conn: conn,
 
 		NoiseEnable: noiseEnable,
@@ -186,53 +436,101 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 		CPRCycle:    cprCycle,
 		Encless:     conf.Encless,
 		MTU:         conf.MTU,
+		Mode:        conf.Mode,
+		Suite:       conf.Suite,
+		Feistel:     conf.Feistel,
+		Framed:      conf.Framed,
 
-		key: key,
+		ReplayWindow: conf.ReplayWindow,
+
+		mtuMax: conf.MTU,
+
+		key:      key,
+		isClient: isClient,
 
 		Timeout:     timeout,
 		Established: now,
 		LastPing:    now,
+		Rekeyed:     now,
+		Rekey:       conf.Rekey,
 
-		bufR:     make([]byte, bufSize),
-		bufT:     make([]byte, bufSize),
-		tagR:     new([TagSize]byte),
-		tagT:     new([TagSize]byte),
-		keyAuthR: new([SSize]byte),
-		keyAuthT: new([SSize]byte),
+		bufR: make([]byte, bufSize),
+		bufT: make([]byte, bufSize),
+		outT: make([]byte, bufSize+TagSize+NonceSize),
 	}
 
-	if isClient {
-		peer.noncesT = newNonces(peer.key, 1 + 2)
-		peer.noncesR = newNonces(peer.key, 0 + 2)
-		peer.noncesExpect = newNonces(peer.key, 0 + 2)
-	} else {
-		peer.noncesT = newNonces(peer.key, 0 + 2)
-		peer.noncesR = newNonces(peer.key, 1 + 2)
-		peer.noncesExpect = newNonces(peer.key, 1 + 2)
+	peer.PMTU = peer.wireSize(conf.MTU)
+	peer.nonceNextT, _ = nonceStarts(isClient)
+	peer.noncesT = newNonceGen(peer.key, conf.Feistel)
+	peer.aeadT = conf.Suite.newAEAD(peer.key)
+	peer.nonceT = make([]byte, peer.aeadT.NonceSize())
+	peer.nonceR = make([]byte, peer.aeadT.NonceSize())
+	// Receiving side has its own copy of the key, because transmitting
+	// and receiving keys are changed at different moments while rekeying
+	keyR := new([SSize]byte)
+	copy(keyR[:], key[:])
+	peer.rx = newPeerRx(keyR, conf.Suite, isClient, conf.Feistel, conf.ReplayWindow)
+	peer.NonceExpect = peer.rx.nonceExpect
+	if conf.Framed {
+		peer.framerT = newFramer(key, isClient)
+		peer.framerR = newFramer(key, !isClient)
 	}
+	return &peer
+}
 
-	peer.NonceExpect = make([]byte, NonceSize)
-	nonce := <-peer.noncesExpect
-	copy(peer.NonceExpect, nonce[:])
+// Encrypt and send the frame. Caller must hold BusyT.
+// Transport's 64-bit nonce is prepended with zeros up to AEAD's nonce
+// size and is sent after the AEAD's output.
+func (p *Peer) frameSend(data []byte, pad byte) {
+	var frameSize int
+	if p.NoiseEnable && !p.Encless {
+		frameSize = p.MTU - TagSize - NonceSize
+	} else if p.Encless {
+		frameSize = p.MTU - NonceSize
+	} else {
+		frameSize = len(data) + 1
+	}
+	p.frameSendSized(data, pad, frameSize)
+}
 
-	var i int
-	peer.nonceBucketL = make(map[[NonceSize]byte]struct{}, NonceBucketSize)
-	for i = 0; i < NonceBucketSize; i++ {
-		nonce = <-peer.noncesR
-		peer.nonceBucketL[*nonce] = struct{}{}
+// Encrypt and send the frame padded with zeros up to frameSize.
+// Nothing is sent by the zeroed peer. Caller must hold BusyT.
+func (p *Peer) frameSendSized(data []byte, pad byte, frameSize int) {
+	if p.aeadT == nil {
+		return
 	}
-	peer.nonceBucketM = make(map[[NonceSize]byte]struct{}, NonceBucketSize)
-	for i = 0; i < NonceBucketSize; i++ {
-		nonce = <-peer.noncesR
-		peer.nonceBucketM[*nonce] = struct{}{}
+	SliceZero(p.bufT)
+	// Copy payload to our internal buffer and we are ready to
+	// accept the next one
+	copy(p.bufT, data)
+	p.bufT[len(data)] = pad
+
+	var nonce [NonceSize]byte
+	p.noncesT.nonce(p.nonceNextT, &nonce)
+	p.nonceNextT += 2
+	var out []byte
+	if p.Encless {
+		var err error
+		out, err = EnclessEncode(p.key, nonce[:], p.bufT[:frameSize])
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		copy(p.nonceT[len(p.nonceT)-NonceSize:], nonce[:])
+		out = p.aeadT.Seal(p.outT[:0], p.nonceT, p.bufT[:frameSize], nil)
+		atomic.AddUint64(&p.BytesOut, uint64(len(out)+NonceSize))
 	}
-	peer.nonceBucketH = make(map[[NonceSize]byte]struct{}, NonceBucketSize)
-	for i = 0; i < NonceBucketSize; i++ {
-		nonce = <-peer.noncesR
-		peer.nonceBucketH[*nonce] = struct{}{}
+	out = append(out, nonce[:]...)
+	if p.framerT != nil {
+		out = p.framerT.frame(out)
 	}
-
-	return &peer
+	p.FramesOut++
+	if p.batching {
+		p.batchT[p.batchN] = append(p.batchT[p.batchN][:0], out...)
+		p.batchN++
+		return
+	}
+	p.Conn.Write(out)
 }
 
 // Process incoming Ethernet packet.
@@ -240,60 +538,82 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 // that he is free to receive new packets. Encrypted and authenticated
 // packets will be sent to remote Peer side immediately.
 func (p *Peer) EthProcess(data []byte) {
+	p.BusyT.Lock()
+	p.ethProcess(data)
+	p.BusyT.Unlock()
+}
+
+// Caller must hold BusyT.
+func (p *Peer) ethProcess(data []byte) {
 	if len(data) > p.MTU-1 { // 1 is for padding byte
 		log.Println("Padded data packet size", len(data)+1, "is bigger than MTU", p.MTU, p)
+		p.FramesOversized++
 		return
 	}
-	p.BusyT.Lock()
-
 	// Zero size is a heartbeat packet
-	SliceZero(p.bufT)
 	if len(data) == 0 {
-		p.bufT[S20BS+0] = PadByte
 		p.HeartbeatSent++
 	} else {
-		// Copy payload to our internal buffer and we are ready to
-		// accept the next one
-		copy(p.bufT[S20BS:], data)
-		p.bufT[S20BS+len(data)] = PadByte
 		p.BytesPayloadOut += uint64(len(data))
 	}
+	p.frameSend(data, PadByte)
+}
 
-	if p.NoiseEnable && !p.Encless {
-		p.frameT = p.bufT[S20BS : S20BS+p.MTU-TagSize]
-	} else if p.Encless {
-		p.frameT = p.bufT[S20BS : S20BS+p.MTU]
-	} else {
-		p.frameT = p.bufT[S20BS : S20BS+len(data)+1+NonceSize]
+// Process incoming Ethernet packet and all packets already waiting in
+// the sink, up to UDPBatchSize of them. If peer's connection is a
+// BatchWriter, then all resulting frames are sent at once.
+func (p *Peer) ethProcessBurst(data []byte, sink chan []byte) {
+	bw, ok := p.Conn.(BatchWriter)
+	if !ok {
+		p.EthProcess(data)
+		return
+	}
+	p.BusyT.Lock()
+	if p.batchT == nil {
+		p.batchT = make([][]byte, UDPBatchSize)
+	}
+	p.batching = true
+	p.ethProcess(data)
+Burst:
+	for p.batchN < UDPBatchSize {
+		select {
+		case data = <-sink:
+			p.ethProcess(data)
+		default:
+			break Burst
+		}
+	}
+	p.batching = false
+	if p.batchN > 0 {
+		bw.WriteBatch(p.batchT[:p.batchN])
+		p.batchN = 0
+	}
+	p.BusyT.Unlock()
+}
+
+// Decrypt and authenticate packet with the given receiving state's key.
+// nil is returned if it fails, or if the state is already zeroed.
+func (p *Peer) pktOpen(rx *peerRx, data []byte) []byte {
+	if rx.aead == nil {
+		return nil
 	}
-	copy(p.frameT[len(p.frameT)-NonceSize:], (<-p.noncesT)[:])
-	var out []byte
 	if p.Encless {
-		var err error
-		out, err = EnclessEncode(
-			p.key,
-			p.frameT[len(p.frameT)-NonceSize:],
-			p.frameT[:len(p.frameT)-NonceSize],
+		out, err := EnclessDecode(
+			rx.key,
+			data[len(data)-NonceSize:],
+			data[:len(data)-NonceSize],
 		)
 		if err != nil {
-			panic(err)
+			return nil
 		}
-		out = append(out, p.frameT[len(p.frameT)-NonceSize:]...)
-	} else {
-		salsa20.XORKeyStream(
-			p.bufT[:S20BS+len(p.frameT)-NonceSize],
-			p.bufT[:S20BS+len(p.frameT)-NonceSize],
-			p.frameT[len(p.frameT)-NonceSize:],
-			p.key,
-		)
-		copy(p.keyAuthT[:], p.bufT[:SSize])
-		poly1305.Sum(p.tagT, p.frameT, p.keyAuthT)
-		atomic.AddUint64(&p.BytesOut, uint64(len(p.frameT)+TagSize))
-		out = append(p.tagT[:], p.frameT...)
+		return out
 	}
-	p.FramesOut++
-	p.Conn.Write(out)
-	p.BusyT.Unlock()
+	copy(p.nonceR[len(p.nonceR)-NonceSize:], data[len(data)-NonceSize:])
+	out, err := rx.aead.Open(p.bufR[:0], p.nonceR, data[:len(data)-NonceSize], nil)
+	if err != nil {
+		return nil
+	}
+	return out
 }
 
 func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
@@ -303,115 +623,117 @@ func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
 	if !p.Encless && len(data) > len(p.bufR)-S20BS {
 		return false
 	}
-	var out []byte
 	p.BusyR.Lock()
-	if p.Encless {
-		var err error
-		out, err = EnclessDecode(
-			p.key,
-			data[len(data)-NonceSize:],
-			data[:len(data)-NonceSize],
-		)
-		if err != nil {
-			p.FramesUnauth++
-			p.BusyR.Unlock()
-			return false
-		}
-	} else {
-		for i := 0; i < SSize; i++ {
-			p.bufR[i] = 0
-		}
-		copy(p.bufR[S20BS:], data[TagSize:])
-		salsa20.XORKeyStream(
-			p.bufR[:S20BS+len(data)-TagSize-NonceSize],
-			p.bufR[:S20BS+len(data)-TagSize-NonceSize],
-			data[len(data)-NonceSize:],
-			p.key,
-		)
-		copy(p.keyAuthR[:], p.bufR[:SSize])
-		copy(p.tagR[:], data[:TagSize])
-		if !poly1305.Verify(p.tagR, data[TagSize:], p.keyAuthR) {
-			p.FramesUnauth++
-			p.BusyR.Unlock()
-			return false
-		}
-		out = p.bufR[S20BS : S20BS+len(data)-TagSize-NonceSize]
-	}
-
-	if reorderable {
-		copy(p.nonceRecv[:], data[len(data)-NonceSize:])
-		_, foundL := p.nonceBucketL[p.nonceRecv]
-		_, foundM := p.nonceBucketM[p.nonceRecv]
-		_, foundH := p.nonceBucketH[p.nonceRecv]
-		// If found is none of buckets: either it is too old,
-		// or too new (many packets were lost)
-		if !(foundL || foundM || foundH) {
-			p.FramesDup++
-			p.BusyR.Unlock()
-			return false
-		}
-		// Delete seen nonce
-		if foundL {
-			delete(p.nonceBucketL, p.nonceRecv)
-		}
-		if foundM {
-			delete(p.nonceBucketM, p.nonceRecv)
-		}
-		if foundH {
-			delete(p.nonceBucketH, p.nonceRecv)
-		}
-		// If we are dealing with the latest bucket, create the new one
-		if foundH {
-			p.nonceBucketL, p.nonceBucketM = p.nonceBucketM, p.nonceBucketH
-			p.nonceBucketH = make(map[[NonceSize]byte]struct{})
-			var nonce *[NonceSize]byte
-			for i := 0; i < NonceBucketSize; i++ {
-				nonce = <-p.noncesR
-				p.nonceBucketH[*nonce] = struct{}{}
-			}
-		}
-	} else {
-		if subtle.ConstantTimeCompare(data[len(data)-NonceSize:], p.NonceExpect) != 1 {
-			p.FramesDup++
-			p.BusyR.Unlock()
-			return false
-		}
-		copy(p.NonceExpect, (<-p.noncesExpect)[:])
+	rx := p.rx
+	out := p.pktOpen(rx, data)
+	if out == nil && p.rxAlt != nil &&
+		(p.rxAltPending || (reorderable && time.Now().Before(p.rxAltExpire))) {
+		rx = p.rxAlt
+		out = p.pktOpen(rx, data)
+	}
+	if out == nil {
+		p.FramesUnauth++
+		p.BusyR.Unlock()
+		return false
 	}
+	copy(p.nonceRecv[:], data[len(data)-NonceSize:])
+	if !rx.nonceCheck(&p.nonceRecv, reorderable) {
+		p.FramesDup++
+		p.BusyR.Unlock()
+		return false
+	}
+	// Frame authenticated with the next key: remote side has already
+	// switched to it
+	promoted := rx == p.rxAlt && p.rxPromote()
 
 	p.FramesIn++
 	atomic.AddUint64(&p.BytesIn, uint64(len(data)))
 	p.LastPing = time.Now()
-	p.pktSizeR = bytes.LastIndexByte(out, PadByte)
+	// Padding byte is the last non-zero one
+	for p.pktSizeR = len(out) - 1; p.pktSizeR >= 0; p.pktSizeR-- {
+		if out[p.pktSizeR] != 0 {
+			break
+		}
+	}
 	if p.pktSizeR == -1 {
 		p.BusyR.Unlock()
 		return false
 	}
-	// Validate the pad
-	for i := p.pktSizeR + 1; i < len(out); i++ {
-		if out[i] != 0 {
-			p.BusyR.Unlock()
-			return false
+	if out[p.pktSizeR] == CtrlPadByte {
+		ctrl := make([]byte, p.pktSizeR)
+		copy(ctrl, out)
+		key := new([SSize]byte)
+		copy(key[:], rx.key[:])
+		p.BusyR.Unlock()
+		if promoted {
+			p.rekeyTxSwitch()
 		}
+		defer SliceZero(key[:])
+		return p.ctrlProcess(ctrl, key, len(data))
+	}
+	if out[p.pktSizeR] != PadByte {
+		p.BusyR.Unlock()
+		return false
 	}
 
 	if p.pktSizeR == 0 {
 		p.HeartbeatRecv++
 		p.BusyR.Unlock()
-		return true
+	} else if p.Mode == ModeTUN && !ipPktValid(out[:p.pktSizeR]) {
+		p.BusyR.Unlock()
+		return false
+	} else {
+		p.BytesPayloadIn += uint64(p.pktSizeR)
+		tap.Write(out[:p.pktSizeR])
+		p.BusyR.Unlock()
+	}
+	if promoted {
+		p.rekeyTxSwitch()
 	}
-	p.BytesPayloadIn += uint64(p.pktSizeR)
-	tap.Write(out[:p.pktSizeR])
-	p.BusyR.Unlock()
 	return true
 }
 
+// Process packet received from the new remote address. It is accepted
+// only if it is authenticated with the current key and its serial is
+// greater than any seen before, so the caller can safely move the peer
+// to that address. Even unseen reordered packets are not enough: they
+// could be captured and delayed by an attacker.
+func (p *Peer) PktRoam(data []byte, tap io.Writer) bool {
+	if len(data) < MinPktLength {
+		return false
+	}
+	if !p.Encless && len(data) > len(p.bufR)-S20BS {
+		return false
+	}
+	p.BusyR.Lock()
+	copy(p.nonceRecv[:], data[len(data)-NonceSize:])
+	i, known := p.rx.counter(&p.nonceRecv)
+	ok := known && i%2 == p.rx.parity && i/2 > p.rx.replay.top && p.pktOpen(p.rx, data) != nil
+	p.BusyR.Unlock()
+	if !ok {
+		return false
+	}
+	return p.PktProcess(data, tap, true)
+}
+
+// Move peer to the new remote address and connection.
+func (p *Peer) Roam(addr string, conn io.Writer) {
+	p.BusyT.Lock()
+	p.Addr = addr
+	p.Conn = conn
+	p.BusyT.Unlock()
+	atomic.AddUint64(&p.Roams, 1)
+}
+
+// Process frames from the TAP and send heartbeats to the peer, until
+// terminator is closed. Peer is zeroed after that.
 func PeerTapProcessor(peer *Peer, tap *TAP, terminator chan struct{}) {
 	var data []byte
 	var now time.Time
 	lastSent := time.Now()
 	heartbeat := time.NewTicker(peer.Timeout)
 	if peer.CPRCycle == time.Duration(0) {
+		peer.pmtuCheck(lastSent)
 	RawProcessor:
 		for {
 			select {
@@ -423,8 +745,11 @@ func PeerTapProcessor(peer *Peer, tap *TAP, terminator chan struct{}) {
 					peer.EthProcess(nil)
 					lastSent = now
 				}
+				peer.rekeyCheck(now)
+				peer.pushCheck(now)
+				peer.pmtuCheck(now)
 			case data = <-tap.Sink:
-				peer.EthProcess(data)
+				peer.ethProcessBurst(data, tap.Sink)
 				lastSent = time.Now()
 			}
 		}
@@ -442,10 +767,12 @@ func PeerTapProcessor(peer *Peer, tap *TAP, terminator chan struct{}) {
 			if data == nil {
 				peer.EthProcess(nil)
 			}
+			now = time.Now()
+			peer.rekeyCheck(now)
+			peer.pushCheck(now)
 			time.Sleep(peer.CPRCycle)
 		}
 	}
-	close(terminator)
 	peer.Zero()
 	heartbeat.Stop()
 }
@@ -19,9 +19,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
 	"testing/quick"
 	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/salsa20"
 )
 
 var (
@@ -50,6 +55,7 @@ func init() {
 		Id:      &testPeerId,
 		MTU:     MTUDefault,
 		Timeout: time.Second * time.Duration(TimeoutDefault),
+		Feistel: true,
 	}
 	testPt = make([]byte, 789)
 }
@@ -122,17 +128,12 @@ func BenchmarkEnc(b *testing.B) {
 func BenchmarkDec(b *testing.B) {
 	testPeer = newPeer(true, "foo", Dummy{&testCt}, testConf, new([SSize]byte))
 	testPeer.EthProcess(testPt)
-	testPeer = newPeer(true, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	testPeer = newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
 	orig := make([]byte, len(testCt))
 	copy(orig, testCt)
-	nonce := new([NonceSize]byte)
-	copy(nonce[:], testCt[len(testCt)-NonceSize:])
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		testPeer.nonceBucketL = make(map[[NonceSize]byte]struct{}, 1)
-		testPeer.nonceBucketM = make(map[[NonceSize]byte]struct{}, 1)
-		testPeer.nonceBucketH = make(map[[NonceSize]byte]struct{}, 1)
-		testPeer.nonceBucketL[*nonce] = struct{}{}
+		testPeer.rx.replay = newReplayWindow(testPeer.ReplayWindow)
 		copy(testCt, orig)
 		if !testPeer.PktProcess(testCt, Dummy{nil}, true) {
 			b.Fail()
@@ -140,8 +141,165 @@ func BenchmarkDec(b *testing.B) {
 	}
 }
 
+// Each parallel goroutine has its own pair of peers, like sharded UDP
+// server's workers have. Run it with -cpu 1,2,4,... to see how
+// throughput scales with cores.
+func BenchmarkPeersParallel(b *testing.B) {
+	b.SetBytes(int64(len(testPt)))
+	b.RunParallel(func(pb *testing.PB) {
+		var ct []byte
+		peerT := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+		peerR := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+		for pb.Next() {
+			peerT.EthProcess(testPt)
+			if !peerR.PktProcess(ct, Dummy{nil}, true) {
+				b.Fail()
+			}
+		}
+	})
+}
+
 func TestTransportBigger(t *testing.T) {
 	tmp := make([]byte, MTUMax*4)
 	Rand.Read(tmp)
 	testPeer.PktProcess(tmp, Dummy{nil}, true)
 }
+
+// Former nonces generator goroutine, kept as the reference.
+func testNoncesLegacy(key *[32]byte, i uint64) chan *[NonceSize]byte {
+	macKey := make([]byte, 32)
+	salsa20.XORKeyStream(macKey, make([]byte, 32), make([]byte, 8), key)
+	mac := blake2b.NewMAC(NonceSize, macKey)
+	nonces := make(chan *[NonceSize]byte, 1)
+	go func() {
+		for {
+			buf := new([NonceSize]byte)
+			binary.BigEndian.PutUint64(buf[:], i)
+			mac.Write(buf[:])
+			mac.Sum(buf[:0])
+			nonces <- buf
+			mac.Reset()
+			i += 2
+		}
+	}()
+	return nonces
+}
+
+// Nonces computed on demand from the counters are the same as the ones
+// made by the former generator, so peers without Feistel network
+// nonces still understand each other.
+func TestPeerNoncesLegacy(t *testing.T) {
+	key := new([32]byte)
+	Rand.Read(key[:])
+	g := newNonceGen(key, false)
+	var nonce [NonceSize]byte
+	for _, i := range []uint64{0, 1} {
+		legacy := testNoncesLegacy(key, i)
+		for n := i; n < i+2*1000; n += 2 {
+			g.nonce(n, &nonce)
+			if nonce != *<-legacy {
+				t.Fatal("nonce differs from legacy one", n)
+			}
+		}
+	}
+	g = newNonceGen(key, true)
+	for _, n := range []uint64{0, 1, 2, 1 << 32, 1<<64 - 1} {
+		g.nonce(n, &nonce)
+		if g.counter(&nonce) != n {
+			t.Fatal("counter is not restored from nonce", n)
+		}
+	}
+}
+
+// Nonces MAC keys of both peers made by the real handshake are zeroed
+// together with the peers, while the new peers made by rehandshake get
+// the new ones.
+func TestPeerRehandshakeZero(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	var keyPrev []byte
+	for i := 0; i < 2; i++ {
+		hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+		hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+		hsS.Server(testCt)
+		hsC.Client(testCt)
+		peerS := hsS.Server(testCt)
+		peerC := hsC.Client(testCt)
+		if peerS == nil || peerC == nil {
+			t.Fatal("handshake failed")
+		}
+		hsS.Zero()
+		hsC.Zero()
+		keys := [][]byte{
+			peerS.noncesT.key, peerS.rx.nonces.key,
+			peerC.noncesT.key, peerC.rx.nonces.key,
+		}
+		if bytes.Equal(keys[0], keyPrev) {
+			t.Fatal("rehandshake did not change nonces key")
+		}
+		keyPrev = append([]byte{}, keys[0]...)
+		peerC.EthProcess(testPt)
+		if !peerS.PktProcess(testCt, Dummy{nil}, true) {
+			t.Fatal("unauthenticated")
+		}
+		peerS.Zero()
+		peerC.Zero()
+		for _, key := range keys {
+			if !bytes.Equal(key, make([]byte, len(key))) {
+				t.Fatal("nonces key is not zeroed")
+			}
+		}
+	}
+}
+
+// Zeroed peer neither accepts nor sends anything, even if the packet
+// is authenticated with the very same key.
+func TestPeerZero(t *testing.T) {
+	for _, encless := range []bool{false, true} {
+		conf := *testConf
+		conf.Encless = encless
+		var ct []byte
+		peerT := newPeer(true, "foo", Dummy{&ct}, &conf, new([SSize]byte))
+		peerR := newPeer(false, "foo", Dummy{nil}, &conf, new([SSize]byte))
+		peerT.EthProcess(testPt)
+		peerR.Zero()
+		if peerR.PktProcess(ct, Dummy{nil}, true) {
+			t.Fatal("zeroed peer accepted packet", encless)
+		}
+		for _, b := range peerR.rx.nonces.key {
+			if b != 0 {
+				t.Fatal("nonces key is not zeroed")
+			}
+		}
+		peerT.Zero()
+		ct = nil
+		peerT.EthProcess(testPt)
+		if ct != nil {
+			t.Fatal("zeroed peer sent packet", encless)
+		}
+	}
+}
+
+// Closed terminator stops the processor, even with nobody reading it
+// afterwards.
+func TestPeerTapProcessorTerminate(t *testing.T) {
+	for _, cpr := range []time.Duration{0, time.Millisecond} {
+		peer := newPeer(true, "foo", Dummy{nil}, testConf, new([SSize]byte))
+		peer.CPRCycle = cpr
+		tap := newTAP("test4", MTUDefault, ModeTAP, newTestTAPDev())
+		terminator := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			PeerTapProcessor(peer, tap, terminator)
+			close(done)
+		}()
+		close(terminator)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("processor is not terminated", cpr)
+		}
+		tap.Close()
+	}
+}
@@ -0,0 +1,170 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// Path MTU discovery is made over UDP transport with control frames
+// padded with zeros to the probed datagram size:
+//
+//     A -> B: PMTUPROBE(size) || ZEROS
+//     B -> A: PMTUACK(size)
+//
+// Probes of all candidate sizes are sent at once and the biggest
+// acknowledged one becomes the path MTU. That is repeated periodically,
+// as path can change.
+
+const (
+	CtrlPMTUProbe = byte(0x06)
+	CtrlPMTUAck   = byte(0x07)
+
+	// Smallest probed datagram size
+	PMTUMin = 576 - 20 - 8
+	// How often path MTU is probed
+	PMTUInterval = 10 * time.Minute
+	// How long to wait for probes acknowledgements
+	PMTUWait = 2 * time.Second
+
+	EnvMTU = "GOVPN_MTU"
+)
+
+// Commonly met path MTUs. Probed datagram sizes are them without both
+// IPv4+UDP and IPv6+UDP headers.
+var pmtuCommon = []int{1280, 1360, 1400, 1420, 1440, 1460, 1480, 1492, 1500, 4352, 9000}
+
+// Size of the biggest datagram carrying frames with the given MTU.
+func (p *Peer) wireSize(mtu int) int {
+	if p.NoiseEnable {
+		return mtu
+	}
+	return mtu + TagSize + NonceSize
+}
+
+// MTU of frames fitting in datagrams of the given size.
+func (p *Peer) wireMTU(size int) int {
+	if p.NoiseEnable {
+		return size
+	}
+	return size - TagSize - NonceSize
+}
+
+// Candidate datagram sizes to probe, not bigger than negotiated MTU.
+func (p *Peer) pmtuCandidates() []int {
+	max := p.wireSize(p.mtuMax)
+	sizes := []int{max}
+	for _, mtu := range pmtuCommon {
+		for _, size := range []int{mtu - 20 - 8, mtu - 40 - 8} {
+			if size >= PMTUMin && size < max {
+				sizes = append(sizes, size)
+			}
+		}
+	}
+	return sizes
+}
+
+// Send probes, or finish probing round, calling MTUHandler if MTU is
+// changed.
+func (p *Peer) pmtuCheck(now time.Time) {
+	p.BusyT.Lock()
+	mtu := p.pmtuStep(now)
+	handler := p.MTUHandler
+	p.BusyT.Unlock()
+	if mtu != 0 && handler != nil {
+		handler(mtu)
+	}
+}
+
+// Caller must hold BusyT. Returns new MTU if it is changed, zero
+// otherwise.
+func (p *Peer) pmtuStep(now time.Time) int {
+	if !p.PMTUDiscovery || p.Encless || p.CPR > 0 {
+		return 0
+	}
+	if p.pmtuRound {
+		if now.Before(p.pmtuSent.Add(PMTUWait)) {
+			return 0
+		}
+		p.pmtuRound = false
+		if p.pmtuBest == 0 || p.pmtuBest == p.PMTU {
+			return 0
+		}
+		p.PMTU = p.pmtuBest
+		p.MTU = p.wireMTU(p.PMTU)
+		return p.MTU
+	}
+	if !p.pmtuSent.IsZero() && now.Before(p.pmtuSent.Add(PMTUInterval)) {
+		return 0
+	}
+	p.pmtuRound = true
+	p.pmtuSent = now
+	p.pmtuBest = 0
+	probe := make([]byte, 3)
+	probe[0] = CtrlPMTUProbe
+	for _, size := range p.pmtuCandidates() {
+		binary.BigEndian.PutUint16(probe[1:], uint16(size))
+		p.frameSendSized(probe, CtrlPadByte, size-TagSize-NonceSize)
+	}
+	return 0
+}
+
+// Probe or its acknowledgement is received in the datagram of the
+// given size.
+func (p *Peer) pmtuProcess(ctrl []byte, size int) bool {
+	if len(ctrl) != 3 {
+		return false
+	}
+	probed := int(binary.BigEndian.Uint16(ctrl[1:]))
+	p.BusyT.Lock()
+	defer p.BusyT.Unlock()
+	if ctrl[0] == CtrlPMTUProbe {
+		if probed != size {
+			return false
+		}
+		// Acknowledgement is as small as possible
+		ctrl[0] = CtrlPMTUAck
+		p.frameSendSized(ctrl, CtrlPadByte, len(ctrl)+1)
+		return true
+	}
+	if !p.pmtuRound || probed > p.wireSize(p.mtuMax) {
+		return false
+	}
+	if probed > p.pmtuBest {
+		p.pmtuBest = probed
+	}
+	return true
+}
+
+// Interface's MTU corresponding to peer's current MTU: without padding
+// byte and Ethernet header.
+func (p *Peer) IfaceMTU() int {
+	mtu := p.MTU - 1
+	if p.Mode == ModeTAP {
+		mtu -= EtherSize
+	}
+	return mtu
+}
+
+// Environment variables for the up-script with interface's MTU.
+func (p *Peer) MTUEnv() []string {
+	return []string{EnvMTU + "=" + strconv.Itoa(p.IfaceMTU())}
+}
@@ -0,0 +1,117 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+	"time"
+)
+
+// Network path dropping datagrams bigger than limit. Delivered ones are
+// queued, to process them outside of sender's locks.
+type testPath struct {
+	limit int
+	queue [][]byte
+}
+
+func (p *testPath) Write(b []byte) (int, error) {
+	if len(b) <= p.limit {
+		p.queue = append(p.queue, append([]byte{}, b...))
+	}
+	return len(b), nil
+}
+
+func (p *testPath) deliver(peer *Peer) {
+	queue := p.queue
+	p.queue = nil
+	for _, pkt := range queue {
+		peer.PktProcess(pkt, Dummy{nil}, true)
+	}
+}
+
+func TestHandshakeMTUNegotiation(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	confC := *testConf
+	confC.Verifier = v
+	confC.DSAPriv = v.PasswordApply("does not matter")
+	for _, noise := range []bool{false, true} {
+		for _, mtus := range [][2]int{{1400, MTUDefault}, {MTUDefault, 1400}} {
+			confC.Noise = noise
+			confC.MTU = mtus[0]
+			confS := confC
+			confS.MTU = mtus[1]
+			hsS := NewHandshake("server", Dummy{&testCt}, &confS)
+			hsC := HandshakeStart("client", Dummy{&testCt}, &confC)
+			hsS.Server(testCt)
+			hsC.Client(testCt)
+			peerS := hsS.Server(testCt)
+			if peerS == nil {
+				t.Fatal("server failed", noise, mtus)
+			}
+			if len(testCt) != hsC.FinalSize() {
+				t.Fatal("final message size differs", noise, mtus)
+			}
+			peerC := hsC.Client(testCt)
+			if peerC == nil {
+				t.Fatal("client failed", noise, mtus)
+			}
+			if peerS.MTU != 1400 || peerC.MTU != 1400 {
+				t.Fatal("MTU is not negotiated", peerS.MTU, peerC.MTU)
+			}
+		}
+	}
+}
+
+func TestPMTUDiscovery(t *testing.T) {
+	pathT := &testPath{limit: 1400}
+	pathR := &testPath{limit: 1400}
+	peerT := newPeer(true, "foo", pathT, testConf, new([SSize]byte))
+	peerR := newPeer(false, "foo", pathR, testConf, new([SSize]byte))
+	peerT.PMTUDiscovery = true
+	var changed int
+	peerT.MTUHandler = func(mtu int) { changed = mtu }
+	now := time.Now()
+	peerT.pmtuCheck(now)
+	if len(pathT.queue) == 0 {
+		t.Fatal("no probes sent")
+	}
+	pathT.deliver(peerR)
+	pathR.deliver(peerT)
+	peerT.pmtuCheck(now.Add(PMTUWait))
+	if peerT.PMTU != 1392 || changed != 1392-TagSize-NonceSize {
+		t.Fatal("unexpected path MTU", peerT.PMTU, changed)
+	}
+	peerT.EthProcess(make([]byte, peerT.MTU-1))
+	if len(pathT.queue) != 1 {
+		t.Fatal("biggest frame does not fit path")
+	}
+	peerT.EthProcess(make([]byte, peerT.MTU))
+	if peerT.FramesOversized != 1 {
+		t.Fatal("oversized frame is not counted")
+	}
+	if peerT.IfaceMTU() != changed-1-EtherSize {
+		t.Fatal("unexpected interface MTU", peerT.IfaceMTU())
+	}
+	// Probing is not repeated until the interval passes
+	pathT.queue = nil
+	peerT.pmtuCheck(now.Add(PMTUWait + time.Second))
+	if len(pathT.queue) != 0 {
+		t.Fatal("probes sent too early")
+	}
+}
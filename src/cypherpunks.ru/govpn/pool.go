@@ -0,0 +1,125 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/dchest/blake2b"
+)
+
+// Pool of IPv4 or IPv6 addresses assigned to the peers of the single
+// interface or switch. The first host address of the network is the
+// gateway (server itself). Each peer gets stable address: it is
+// derived from its identity and is kept during the daemon's lifetime.
+type IPPool struct {
+	sync.Mutex
+	network *net.IPNet
+	gateway net.IP
+	// Number of addresses available for the peers
+	size   uint64
+	leases map[PeerId]uint64
+	used   map[uint64]struct{}
+}
+
+func ipAdd(ip net.IP, offset uint64) net.IP {
+	r := make(net.IP, len(ip))
+	copy(r, ip)
+	for i := len(r) - 1; i >= 0 && offset > 0; i-- {
+		offset += uint64(r[i])
+		r[i] = byte(offset)
+		offset >>= 8
+	}
+	return r
+}
+
+// Create addresses pool for the given network, like 10.8.0.0/24.
+func NewIPPool(network *net.IPNet) (*IPPool, error) {
+	ones, bits := network.Mask.Size()
+	if bits == 0 {
+		return nil, errors.New("Non-canonical network mask")
+	}
+	ip := network.IP.Mask(network.Mask)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hostBits := uint(bits - ones)
+	if hostBits > 32 {
+		hostBits = 32
+	}
+	size := uint64(1) << hostBits
+	// Network address and gateway
+	reserved := uint64(2)
+	if bits == 32 {
+		// Broadcast address
+		reserved++
+	}
+	if size <= reserved {
+		return nil, errors.New("Too small network for the pool: " + network.String())
+	}
+	return &IPPool{
+		network: &net.IPNet{IP: ip, Mask: network.Mask},
+		gateway: ipAdd(ip, 1),
+		size:    size - reserved,
+		leases:  make(map[PeerId]uint64),
+		used:    make(map[uint64]struct{}),
+	}, nil
+}
+
+func (p *IPPool) Network() *net.IPNet {
+	return p.network
+}
+
+func (p *IPPool) Gateway() net.IP {
+	return p.gateway
+}
+
+// Is that pool made for the same network.
+func (p *IPPool) Equal(network *net.IPNet) bool {
+	return p.network.IP.Equal(network.IP.Mask(network.Mask)) &&
+		bytes.Equal(p.network.Mask, network.Mask)
+}
+
+// Get the address of the peer, with the network's prefix length.
+func (p *IPPool) Lease(id *PeerId) (*net.IPNet, error) {
+	p.Lock()
+	defer p.Unlock()
+	n, exists := p.leases[*id]
+	if !exists {
+		if uint64(len(p.used)) >= p.size {
+			return nil, errors.New("Addresses pool is exhausted: " + p.network.String())
+		}
+		hsh := blake2b.Sum256(id[:])
+		n = binary.BigEndian.Uint64(hsh[:8]) % p.size
+		for {
+			if _, taken := p.used[n]; !taken {
+				break
+			}
+			n = (n + 1) % p.size
+		}
+		p.leases[*id] = n
+		p.used[n] = struct{}{}
+	}
+	// Skip network address and gateway
+	return &net.IPNet{IP: ipAdd(p.network.IP, 2+n), Mask: p.network.Mask}, nil
+}
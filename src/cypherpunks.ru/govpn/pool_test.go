@@ -0,0 +1,87 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPPoolLease(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.8.0.0/29")
+	pool, err := NewIPPool(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pool.Gateway().Equal(net.ParseIP("10.8.0.1")) {
+		t.Fatal("gateway", pool.Gateway())
+	}
+	seen := make(map[string]struct{})
+	var first string
+	for i := 0; i < 5; i++ {
+		id := PeerId{byte(i)}
+		addr, err := pool.Lease(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !network.Contains(addr.IP) || addr.IP[3] < 2 || addr.IP[3] > 6 {
+			t.Fatal("address out of range", addr)
+		}
+		if addr.String()[len(addr.String())-3:] != "/29" {
+			t.Fatal("prefix length is missing", addr)
+		}
+		if _, exists := seen[addr.String()]; exists {
+			t.Fatal("duplicate address", addr)
+		}
+		seen[addr.String()] = struct{}{}
+		if i == 0 {
+			first = addr.String()
+		}
+	}
+	id := PeerId{byte(0)}
+	if addr, _ := pool.Lease(&id); addr.String() != first {
+		t.Fatal("address is not stable")
+	}
+	id = PeerId{byte(5)}
+	if _, err = pool.Lease(&id); err == nil {
+		t.Fatal("pool is not exhausted")
+	}
+}
+
+func TestIPPoolIPv6(t *testing.T) {
+	_, network, _ := net.ParseCIDR("fd00::/64")
+	pool, err := NewIPPool(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pool.Gateway().Equal(net.ParseIP("fd00::1")) {
+		t.Fatal("gateway", pool.Gateway())
+	}
+	addr, err := pool.Lease(&testPeerId)
+	if err != nil || !network.Contains(addr.IP) {
+		t.Fatal(addr, err)
+	}
+}
+
+func TestIPPoolTooSmall(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.8.0.0/31")
+	if _, err := NewIPPool(network); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,216 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xFF
+	socks5CmdConnect   = 1
+	socks5AtypIPv4     = 1
+	socks5AtypDomain   = 3
+	socks5AtypIPv6     = 4
+)
+
+// Connect to addr through proxy server. proxy is in
+// [http|socks5://][user:password@]host:port format, plain HTTP CONNECT
+// is used if scheme is omitted. auth is optional user:password pair
+// used if it is absent in proxy's address.
+func ProxyDial(proxy, auth, addr string) (net.Conn, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// Error contains the whole URL with possible password
+		return nil, errors.New("Invalid proxy address: " + ProxyRedact(proxy))
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = u.User.Username() + ":" + password
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, RWTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(RWTimeout))
+	switch u.Scheme {
+	case "http":
+		err = proxyHTTP(conn, auth, addr)
+	case "socks5":
+		err = proxySOCKS5(conn, auth, addr)
+	default:
+		err = errors.New("Unknown proxy scheme: " + u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Proxy address with the password masked, suitable for logging.
+func ProxyRedact(proxy string) string {
+	var scheme string
+	if i := strings.Index(proxy, "://"); i != -1 {
+		scheme, proxy = proxy[:i+3], proxy[i+3:]
+	}
+	if i := strings.LastIndex(proxy, "@"); i != -1 {
+		user := proxy[:i]
+		if j := strings.Index(user, ":"); j != -1 {
+			user = user[:j] + ":xxxxx"
+		}
+		proxy = user + "@" + proxy[i+1:]
+	}
+	return scheme + proxy
+}
+
+func proxyHTTP(conn net.Conn, auth, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\n"
+	req += "Host: " + addr + "\n"
+	if auth != "" {
+		req += "Proxy-Authorization: Basic "
+		req += base64.StdEncoding.EncodeToString([]byte(auth)) + "\n"
+	}
+	req += "\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(
+		bufio.NewReader(conn),
+		&http.Request{Method: "CONNECT"},
+	)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Unexpected response from proxy: " + resp.Status)
+	}
+	return nil
+}
+
+// SOCKS5 (RFC 1928) CONNECT with optional username/password
+// authentication (RFC 1929).
+func proxySOCKS5(conn net.Conn, auth, addr string) error {
+	host, portRaw, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portRaw, 10, 16)
+	if err != nil {
+		return err
+	}
+	method := byte(socks5AuthNone)
+	if auth != "" {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2+255+255+1)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return errors.New("Unexpected SOCKS version")
+	}
+	if buf[1] != method {
+		return errors.New("SOCKS authentication method is not accepted")
+	}
+	if method == socks5AuthPassword {
+		cols := strings.SplitN(auth, ":", 2)
+		if len(cols) != 2 || len(cols[0]) > 255 || len(cols[1]) > 255 {
+			return errors.New("Invalid SOCKS credentials")
+		}
+		req := []byte{1, byte(len(cols[0]))}
+		req = append(req, cols[0]...)
+		req = append(req, byte(len(cols[1])))
+		req = append(req, cols[1]...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("SOCKS authentication failed")
+		}
+	}
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("Too long hostname")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AtypIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AtypIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return errors.New("Unexpected SOCKS version")
+	}
+	if buf[1] != 0 {
+		return errors.New("SOCKS connect failed: code " + strconv.Itoa(int(buf[1])))
+	}
+	// Skip bound address and port
+	var n int
+	switch buf[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return errors.New("Unexpected SOCKS address type")
+	}
+	_, err = io.ReadFull(conn, buf[:n+2])
+	return err
+}
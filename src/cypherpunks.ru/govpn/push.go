@@ -0,0 +1,218 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Server pushes the network configuration to the client inside
+// established transport, using control frames:
+//
+//     S -> C: PUSH(configuration)
+//     C -> S: PUSHACK
+//
+// Push is repeated on heartbeats until it is acknowledged.
+
+const (
+	CtrlPush    = byte(0x04)
+	CtrlPushAck = byte(0x05)
+
+	// How long to wait for push acknowledgement before sending it again
+	PushRetry = 5 * time.Second
+
+	EnvIP4Address = "GOVPN_IP4_ADDRESS"
+	EnvIP4Gateway = "GOVPN_IP4_GATEWAY"
+	EnvIP6Address = "GOVPN_IP6_ADDRESS"
+	EnvIP6Gateway = "GOVPN_IP6_GATEWAY"
+	EnvRoutes     = "GOVPN_ROUTES"
+	EnvDNS        = "GOVPN_DNS"
+)
+
+// Network configuration pushed to the client.
+type PushConf struct {
+	Addr4    *net.IPNet
+	Gateway4 net.IP
+	Addr6    *net.IPNet
+	Gateway6 net.IP
+	Routes   []*net.IPNet
+	DNS      []net.IP
+}
+
+// Serialize configuration as "key value" lines.
+func (pc *PushConf) Marshal() []byte {
+	var b bytes.Buffer
+	line := func(k, v string) {
+		b.WriteString(k + " " + v + "\n")
+	}
+	if pc.Addr4 != nil {
+		line("addr4", pc.Addr4.String())
+	}
+	if pc.Gateway4 != nil {
+		line("gw4", pc.Gateway4.String())
+	}
+	if pc.Addr6 != nil {
+		line("addr6", pc.Addr6.String())
+	}
+	if pc.Gateway6 != nil {
+		line("gw6", pc.Gateway6.String())
+	}
+	for _, route := range pc.Routes {
+		line("route", route.String())
+	}
+	for _, dns := range pc.DNS {
+		line("dns", dns.String())
+	}
+	return b.Bytes()
+}
+
+func pushCIDRParse(s string) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	network.IP = ip
+	return network, nil
+}
+
+func pushIPParse(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Invalid IP address: " + s)
+	}
+	return ip, nil
+}
+
+// Parse serialized configuration. Unknown keys are rejected.
+func PushConfFromBytes(data []byte) (*PushConf, error) {
+	pc := PushConf{}
+	var err error
+	for _, l := range strings.Split(string(data), "\n") {
+		if l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, " ", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Invalid push line: " + l)
+		}
+		switch kv[0] {
+		case "addr4":
+			pc.Addr4, err = pushCIDRParse(kv[1])
+		case "gw4":
+			pc.Gateway4, err = pushIPParse(kv[1])
+		case "addr6":
+			pc.Addr6, err = pushCIDRParse(kv[1])
+		case "gw6":
+			pc.Gateway6, err = pushIPParse(kv[1])
+		case "route":
+			var route *net.IPNet
+			_, route, err = net.ParseCIDR(kv[1])
+			pc.Routes = append(pc.Routes, route)
+		case "dns":
+			var dns net.IP
+			dns, err = pushIPParse(kv[1])
+			pc.DNS = append(pc.DNS, dns)
+		default:
+			err = errors.New("Unknown push key: " + kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pc, nil
+}
+
+// Environment variables for the up-script.
+func (pc *PushConf) Env() []string {
+	var env []string
+	if pc.Addr4 != nil {
+		env = append(env, EnvIP4Address+"="+pc.Addr4.String())
+	}
+	if pc.Gateway4 != nil {
+		env = append(env, EnvIP4Gateway+"="+pc.Gateway4.String())
+	}
+	if pc.Addr6 != nil {
+		env = append(env, EnvIP6Address+"="+pc.Addr6.String())
+	}
+	if pc.Gateway6 != nil {
+		env = append(env, EnvIP6Gateway+"="+pc.Gateway6.String())
+	}
+	routes := make([]string, 0, len(pc.Routes))
+	for _, route := range pc.Routes {
+		routes = append(routes, route.String())
+	}
+	env = append(env, EnvRoutes+"="+strings.Join(routes, " "))
+	dnses := make([]string, 0, len(pc.DNS))
+	for _, dns := range pc.DNS {
+		dnses = append(dnses, dns.String())
+	}
+	env = append(env, EnvDNS+"="+strings.Join(dnses, " "))
+	return env
+}
+
+// Start pushing the configuration to the client.
+func (p *Peer) PushSet(pc *PushConf) error {
+	data := append([]byte{CtrlPush}, pc.Marshal()...)
+	if len(data) > p.MTU-1 {
+		return errors.New("Pushed configuration does not fit in MTU")
+	}
+	p.BusyT.Lock()
+	p.pushData = data
+	p.pushSent = time.Now()
+	p.frameSend(p.pushData, CtrlPadByte)
+	p.BusyT.Unlock()
+	return nil
+}
+
+// Repeat unacknowledged push.
+func (p *Peer) pushCheck(now time.Time) {
+	p.BusyT.Lock()
+	if p.pushData != nil && now.After(p.pushSent.Add(PushRetry)) {
+		p.pushSent = now
+		p.frameSend(p.pushData, CtrlPadByte)
+	}
+	p.BusyT.Unlock()
+}
+
+// Acknowledge received configuration and pass it to the handler once.
+func (p *Peer) pushProcess(data []byte) bool {
+	pc, err := PushConfFromBytes(data)
+	if err != nil {
+		return false
+	}
+	p.BusyT.Lock()
+	p.frameSend([]byte{CtrlPushAck}, CtrlPadByte)
+	handler := p.PushHandler
+	p.PushHandler = nil
+	p.BusyT.Unlock()
+	if handler != nil {
+		handler(pc)
+	}
+	return true
+}
+
+func (p *Peer) pushAck() {
+	p.BusyT.Lock()
+	p.pushData = nil
+	p.BusyT.Unlock()
+}
@@ -0,0 +1,79 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func testPushConf() *PushConf {
+	addr4, _ := pushCIDRParse("10.8.0.5/24")
+	addr6, _ := pushCIDRParse("fd00::5/64")
+	_, route4, _ := net.ParseCIDR("0.0.0.0/1")
+	_, route6, _ := net.ParseCIDR("2000::/3")
+	return &PushConf{
+		Addr4:    addr4,
+		Gateway4: net.ParseIP("10.8.0.1"),
+		Addr6:    addr6,
+		Gateway6: net.ParseIP("fd00::1"),
+		Routes:   []*net.IPNet{route4, route6},
+		DNS:      []net.IP{net.ParseIP("10.8.0.1"), net.ParseIP("fd00::1")},
+	}
+}
+
+func TestPushConfMarshal(t *testing.T) {
+	pc := testPushConf()
+	parsed, err := PushConfFromBytes(pc.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Env(), pc.Env()) {
+		t.Fatal(parsed.Env())
+	}
+	if _, err = PushConfFromBytes([]byte("evil /bin/sh\n")); err == nil {
+		t.Fatal("unknown key is accepted")
+	}
+}
+
+func TestPushTransport(t *testing.T) {
+	var ctS, ctC []byte
+	peerS := newPeer(false, "foo", Dummy{&ctS}, testConf, new([SSize]byte))
+	peerC := newPeer(true, "foo", Dummy{&ctC}, testConf, new([SSize]byte))
+	var received *PushConf
+	peerC.PushHandler = func(pc *PushConf) {
+		received = pc
+	}
+	if err := peerS.PushSet(testPushConf()); err != nil {
+		t.Fatal(err)
+	}
+	if !peerC.PktProcess(ctS, Dummy{nil}, true) {
+		t.Fatal("push is not processed")
+	}
+	if received == nil || received.Addr4.String() != "10.8.0.5/24" {
+		t.Fatal("push is not received")
+	}
+	if !peerS.PktProcess(ctC, Dummy{nil}, true) {
+		t.Fatal("ack is not processed")
+	}
+	if peerS.pushData != nil {
+		t.Fatal("push is not acknowledged")
+	}
+}
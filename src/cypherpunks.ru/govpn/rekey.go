@@ -0,0 +1,264 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/curve25519"
+)
+
+// In-band rekeying is made through the control frames exchange inside
+// already established transport:
+//
+//     A -> B: REQ(DHPubA)
+//     B -> A: RESP(DHPubB, first bytes of DHPubA)
+//     A -> B: DONE, then A sends everything with the new key
+//     B -> A: DONE, then B sends everything with the new key
+//
+// New key is BLAKE2b-MAC(key=K, DH(DHPrivA, DHPubB)). Each side is able
+// to receive frames with the new key before it sends its own DONE.
+// Previous key is still accepted during RekeyOverlap for late UDP
+// packets. DONE frames tell exactly when to switch keys for TCP.
+
+const (
+	CtrlRekeyReq  = byte(0x01)
+	CtrlRekeyResp = byte(0x02)
+	CtrlRekeyDone = byte(0x03)
+
+	// How long to wait for rekey response before trying again
+	RekeyRetry = 10 * time.Second
+	// How long packets with the previous key are still accepted
+	RekeyOverlap = 10 * time.Second
+
+	rekeyTagSize = 8
+)
+
+func rekeyKeypairGen() (*[32]byte, *[32]byte) {
+	priv := new([32]byte)
+	pub := new([32]byte)
+	if _, err := io.ReadFull(Rand, priv[:]); err != nil {
+		log.Fatalln("Error reading random for DH private key:", err)
+	}
+	curve25519.ScalarBaseMult(pub, priv)
+	return priv, pub
+}
+
+func rekeyKeyDerive(key *[SSize]byte, priv, pub *[32]byte) *[SSize]byte {
+	shared := new([32]byte)
+	curve25519.ScalarMult(shared, priv, pub)
+	mac := blake2b.NewMAC(SSize, key[:])
+	mac.Write(shared[:])
+	SliceZero(shared[:])
+	k := new([SSize]byte)
+	mac.Sum(k[:0])
+	return k
+}
+
+// Start rekeying if either rekey interval passed, or too many bytes
+// were transferred with the current key. Also retry unanswered
+// requests and forget the expired previous key.
+func (p *Peer) rekeyCheck(now time.Time) {
+	if p.Rekey == 0 {
+		return
+	}
+	p.BusyT.Lock()
+	p.BusyR.Lock()
+	if p.rxAlt != nil && !p.rxAltPending && now.After(p.rxAltExpire) {
+		p.rxAlt.zero()
+		p.rxAlt = nil
+	}
+	p.BusyR.Unlock()
+	if p.rekeyPriv != nil {
+		if now.Before(p.rekeyStarted.Add(RekeyRetry)) {
+			p.BusyT.Unlock()
+			return
+		}
+	} else if p.keyNext != nil ||
+		(now.Before(p.Rekeyed.Add(p.Rekey)) && p.KeyBytes() < MaxBytesPerKey/2) {
+		p.BusyT.Unlock()
+		return
+	}
+	p.rekeyStart(now)
+	p.BusyT.Unlock()
+}
+
+// Initiate rekeying right now, unless it is already in progress.
+func (p *Peer) RekeyForce() {
+	p.BusyT.Lock()
+	if p.rekeyPriv == nil && p.keyNext == nil {
+		p.rekeyStart(time.Now())
+	}
+	p.BusyT.Unlock()
+}
+
+// Send rekey request. Caller must hold BusyT.
+func (p *Peer) rekeyStart(now time.Time) {
+	if p.rekeyPriv != nil {
+		SliceZero(p.rekeyPriv[:])
+	}
+	p.rekeyPriv, p.rekeyPub = rekeyKeypairGen()
+	p.rekeyStarted = now
+	p.frameSend(append([]byte{CtrlRekeyReq}, p.rekeyPub[:]...), CtrlPadByte)
+}
+
+// Start sending with the new key. Caller must hold BusyT.
+func (p *Peer) txSwitch(key *[SSize]byte) {
+	SliceZero(p.key[:])
+	p.key = key
+	p.noncesT.zero()
+	p.nonceNextT, _ = nonceStarts(p.isClient)
+	p.noncesT = newNonceGen(p.key, p.Feistel)
+	p.aeadT = p.Suite.newAEAD(p.key)
+	p.Rekeyed = time.Now()
+	atomic.StoreUint64(
+		&p.bytesKey,
+		atomic.LoadUint64(&p.BytesIn)+atomic.LoadUint64(&p.BytesOut),
+	)
+	atomic.AddUint64(&p.Rekeys, 1)
+}
+
+// Prepare receiving state for the next key. Caller must hold BusyR.
+func (p *Peer) rxAltSet(key *[SSize]byte) {
+	if p.rxAlt != nil {
+		p.rxAlt.zero()
+	}
+	keyR := new([SSize]byte)
+	copy(keyR[:], key[:])
+	p.rxAlt = newPeerRx(keyR, p.Suite, p.isClient, p.Feistel, p.ReplayWindow)
+	p.rxAltPending = true
+}
+
+// Make the next key the current one for receiving, leaving previous
+// one for a while. Caller must hold BusyR.
+func (p *Peer) rxPromote() bool {
+	if !p.rxAltPending {
+		return false
+	}
+	p.rx, p.rxAlt = p.rxAlt, p.rx
+	p.rxAltPending = false
+	p.rxAltExpire = time.Now().Add(RekeyOverlap)
+	p.NonceExpect = p.rx.nonceExpect
+	return true
+}
+
+// Remote side has switched to the new key, so we can do it too.
+func (p *Peer) rekeyTxSwitch() {
+	p.BusyT.Lock()
+	if p.keyNext != nil {
+		p.frameSend([]byte{CtrlRekeyDone}, CtrlPadByte)
+		p.txSwitch(p.keyNext)
+		p.keyNext = nil
+	}
+	p.BusyT.Unlock()
+}
+
+func (p *Peer) rekeyRespond(key *[SSize]byte, pubRemote *[32]byte) {
+	p.BusyT.Lock()
+	if p.rekeyPriv != nil {
+		// Both sides started rekeying simultaneously: server's
+		// request wins
+		if !p.isClient {
+			p.BusyT.Unlock()
+			return
+		}
+		SliceZero(p.rekeyPriv[:])
+		p.rekeyPriv = nil
+	}
+	priv, pub := rekeyKeypairGen()
+	keyNew := rekeyKeyDerive(key, priv, pubRemote)
+	SliceZero(priv[:])
+	p.BusyR.Lock()
+	p.rxAltSet(keyNew)
+	p.BusyR.Unlock()
+	if p.keyNext != nil {
+		SliceZero(p.keyNext[:])
+	}
+	p.keyNext = keyNew
+	resp := append([]byte{CtrlRekeyResp}, pub[:]...)
+	p.frameSend(append(resp, pubRemote[:rekeyTagSize]...), CtrlPadByte)
+	p.BusyT.Unlock()
+}
+
+func (p *Peer) rekeyFinish(key *[SSize]byte, pubRemote *[32]byte, tag []byte) {
+	p.BusyT.Lock()
+	if p.rekeyPriv == nil || subtle.ConstantTimeCompare(tag, p.rekeyPub[:rekeyTagSize]) != 1 {
+		// Response to either unknown or already retried request
+		p.BusyT.Unlock()
+		return
+	}
+	keyNew := rekeyKeyDerive(key, p.rekeyPriv, pubRemote)
+	SliceZero(p.rekeyPriv[:])
+	p.rekeyPriv = nil
+	p.BusyR.Lock()
+	p.rxAltSet(keyNew)
+	p.BusyR.Unlock()
+	p.frameSend([]byte{CtrlRekeyDone}, CtrlPadByte)
+	p.txSwitch(keyNew)
+	p.BusyT.Unlock()
+}
+
+// Process authenticated control frame. key is the one it was
+// authenticated with, size is the received datagram's size.
+func (p *Peer) ctrlProcess(ctrl []byte, key *[SSize]byte, size int) bool {
+	if len(ctrl) == 0 {
+		return false
+	}
+	pubRemote := new([32]byte)
+	switch ctrl[0] {
+	case CtrlRekeyReq:
+		if len(ctrl) != 1+32 {
+			return false
+		}
+		copy(pubRemote[:], ctrl[1:])
+		p.rekeyRespond(key, pubRemote)
+	case CtrlRekeyResp:
+		if len(ctrl) != 1+32+rekeyTagSize {
+			return false
+		}
+		copy(pubRemote[:], ctrl[1:1+32])
+		p.rekeyFinish(key, pubRemote, ctrl[1+32:])
+	case CtrlRekeyDone:
+		p.BusyR.Lock()
+		promoted := p.rxPromote()
+		p.BusyR.Unlock()
+		if promoted {
+			p.rekeyTxSwitch()
+		}
+	case CtrlPush:
+		return p.pushProcess(ctrl[1:])
+	case CtrlPushAck:
+		p.pushAck()
+	case CtrlPMTUProbe, CtrlPMTUAck:
+		return p.pmtuProcess(ctrl, size)
+	case CtrlGoodbye:
+		if len(ctrl) != 1+1 {
+			return false
+		}
+		p.goodbyeProcess(GoodbyeReason(ctrl[1]))
+	default:
+		return false
+	}
+	return true
+}
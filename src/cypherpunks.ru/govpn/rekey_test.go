@@ -0,0 +1,140 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type testPipe struct {
+	frames *[][]byte
+}
+
+func (tp testPipe) Write(b []byte) (int, error) {
+	frame := make([]byte, len(b))
+	copy(frame, b)
+	*tp.frames = append(*tp.frames, frame)
+	return len(b), nil
+}
+
+func testPipePop(frames *[][]byte) []byte {
+	frame := (*frames)[0]
+	*frames = (*frames)[1:]
+	return frame
+}
+
+func TestRekey(t *testing.T) {
+	var toS, toC [][]byte
+	var got []byte
+	key := new([SSize]byte)
+	Rand.Read(key[:])
+	keyS := new([SSize]byte)
+	copy(keyS[:], key[:])
+	peerC := newPeer(true, "foo", testPipe{&toS}, testConf, key)
+	peerS := newPeer(false, "foo", testPipe{&toC}, testConf, keyS)
+	tap := Dummy{&got}
+
+	peerC.Rekey = time.Nanosecond
+	peerC.rekeyCheck(time.Now())
+	if len(toS) != 1 {
+		t.Fatal("no rekey request")
+	}
+	// Request
+	if !peerS.PktProcess(testPipePop(&toS), tap, true) {
+		t.Fatal("request is not processed")
+	}
+	// Response, with in-flight old key packet from the server
+	peerS.EthProcess([]byte("old from server"))
+	if !peerC.PktProcess(testPipePop(&toC), tap, true) {
+		t.Fatal("response is not processed")
+	}
+	peerC.EthProcess([]byte("new from client"))
+	// Reordered: new key packet before DONE
+	done := testPipePop(&toS)
+	if !peerS.PktProcess(testPipePop(&toS), tap, true) {
+		t.Fatal("new key packet is not accepted")
+	}
+	if bytes.Compare(got, []byte("new from client")) != 0 {
+		t.Fatal("invalid payload")
+	}
+	if peerS.PktProcess(done, tap, true) != true {
+		t.Fatal("DONE is not processed")
+	}
+	if peerC.Rekeys != 1 || peerS.Rekeys != 1 {
+		t.Fatal("keys are not switched")
+	}
+	if bytes.Compare(peerC.key[:], peerS.key[:]) != 0 {
+		t.Fatal("keys differ")
+	}
+	if bytes.Compare(peerC.key[:], key[:]) == 0 {
+		t.Fatal("key has not changed")
+	}
+	// Late old key packet, server's DONE and new key one
+	if !peerC.PktProcess(testPipePop(&toC), tap, true) {
+		t.Fatal("old key packet is not accepted during overlap")
+	}
+	if bytes.Compare(got, []byte("old from server")) != 0 {
+		t.Fatal("invalid payload")
+	}
+	if !peerC.PktProcess(testPipePop(&toC), tap, true) {
+		t.Fatal("server's DONE is not processed")
+	}
+	peerS.EthProcess([]byte("new from server"))
+	if !peerC.PktProcess(testPipePop(&toC), tap, true) {
+		t.Fatal("new key packet is not accepted")
+	}
+	if bytes.Compare(got, []byte("new from server")) != 0 {
+		t.Fatal("invalid payload")
+	}
+	if peerC.KeyBytes() >= peerC.BytesIn+peerC.BytesOut {
+		t.Fatal("key bytes counter is not reset")
+	}
+}
+
+func TestRekeyStream(t *testing.T) {
+	var toS, toC [][]byte
+	var got []byte
+	key := new([SSize]byte)
+	keyS := new([SSize]byte)
+	peerC := newPeer(true, "foo", testPipe{&toS}, testConf, key)
+	peerS := newPeer(false, "foo", testPipe{&toC}, testConf, keyS)
+	tap := Dummy{&got}
+	peerS.RekeyForce()
+	for len(toS) > 0 || len(toC) > 0 {
+		for len(toC) > 0 {
+			if !peerC.PktProcess(testPipePop(&toC), tap, false) {
+				t.Fatal("client failed to process")
+			}
+		}
+		for len(toS) > 0 {
+			if !peerS.PktProcess(testPipePop(&toS), tap, false) {
+				t.Fatal("server failed to process")
+			}
+		}
+	}
+	if peerC.Rekeys != 1 || peerS.Rekeys != 1 {
+		t.Fatal("keys are not switched")
+	}
+	peerC.EthProcess([]byte("foobar"))
+	if !peerS.PktProcess(testPipePop(&toS), tap, false) {
+		t.Fatal("new key packet is not accepted")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+const (
+	// Default size of the replay protection window, in packets
+	ReplayWindowDefault = 2048
+)
+
+// Sliding window of already received packets' serial numbers, like
+// IPsec's one (RFC 6479). Bitmap is a ring of 64-bit words, with one
+// spare word, so advancing the window does not require shifting.
+type replayWindow struct {
+	bitmap []uint64
+	size   uint64
+	top    uint64
+}
+
+func newReplayWindow(size int) *replayWindow {
+	if size <= 0 {
+		size = ReplayWindowDefault
+	}
+	words := (size + 63) / 64
+	w := replayWindow{
+		bitmap: make([]uint64, words+1),
+		size:   uint64(words * 64),
+	}
+	// Zero serial is never used
+	w.bitmap[0] = 1
+	return &w
+}
+
+// Check that serial number was not seen before and is not too old,
+// then remember it. Serial numbers greater than any seen before are
+// always accepted, moving the window forward.
+func (w *replayWindow) check(seq uint64) bool {
+	words := uint64(len(w.bitmap))
+	if seq > w.top {
+		wordTop := w.top / 64
+		wordNew := seq / 64
+		diff := wordNew - wordTop
+		if diff > words {
+			diff = words
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(wordTop+i)%words] = 0
+		}
+		w.top = seq
+	} else if w.top-seq >= w.size {
+		return false
+	}
+	word := &w.bitmap[(seq/64)%words]
+	bit := uint64(1) << (seq % 64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
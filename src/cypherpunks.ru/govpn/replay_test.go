@@ -0,0 +1,189 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow(128)
+	for _, seq := range []uint64{1, 2, 3, 5, 4, 200, 100, 150} {
+		if !w.check(seq) {
+			t.Fatal("rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{0, 1, 5, 200, 150, 10, 72} {
+		if w.check(seq) {
+			t.Fatal("accepted", seq)
+		}
+	}
+	if !w.check(73) {
+		t.Fatal("rejected the oldest one")
+	}
+	// Resynchronization after huge loss
+	if !w.check(1 << 40) {
+		t.Fatal("rejected far ahead one")
+	}
+	if w.check(199) || w.check(1<<40) {
+		t.Fatal("accepted after resynchronization")
+	}
+	if !w.check(1<<40 - 1) {
+		t.Fatal("rejected reordered after resynchronization")
+	}
+}
+
+func TestNonceCounter(t *testing.T) {
+	g := newNonceGen(new([SSize]byte), true)
+	var nonce [NonceSize]byte
+	f := func(i uint64) bool {
+		g.nonce(i, &nonce)
+		return g.counter(&nonce) == i
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransportLoss(t *testing.T) {
+	var ct []byte
+	peerT := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerR := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	for i := 0; i < 10*ReplayWindowDefault; i++ {
+		peerT.EthProcess(testPt)
+	}
+	if !peerR.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("rejected after loss")
+	}
+	if peerR.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("accepted replayed")
+	}
+	peerR.Zero()
+	peerT.Zero()
+}
+
+func TestTransportReflected(t *testing.T) {
+	var ct []byte
+	peer := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peer.EthProcess(testPt)
+	if peer.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("accepted own packet")
+	}
+}
+
+func TestPktProcessNoAlloc(t *testing.T) {
+	var ct []byte
+	peerT := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerR := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	allocs := testing.AllocsPerRun(100, func() {
+		peerT.EthProcess(testPt)
+		if !peerR.PktProcess(ct, Dummy{nil}, true) {
+			t.Fatal("rejected")
+		}
+	})
+	if allocs > 0 {
+		t.Fatal("allocations on the hot path", allocs)
+	}
+}
+
+func TestPktRoam(t *testing.T) {
+	var ct []byte
+	peerT := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerR := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	peerT.EthProcess(testPt)
+	replayed := append([]byte{}, ct...)
+	if !peerR.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("rejected")
+	}
+	if peerR.PktRoam(replayed, Dummy{nil}) {
+		t.Fatal("roamed with replayed packet")
+	}
+	peerT.EthProcess(testPt)
+	delayed := append([]byte{}, ct...)
+	peerT.EthProcess(testPt)
+	if !peerR.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("rejected")
+	}
+	if peerR.PktRoam(delayed, Dummy{nil}) {
+		t.Fatal("roamed with older unseen packet")
+	}
+	if !peerR.PktProcess(delayed, Dummy{nil}, true) {
+		t.Fatal("rejected reordered")
+	}
+	key := new([SSize]byte)
+	key[0] = 1
+	other := newPeer(false, "foo", Dummy{nil}, testConf, key)
+	peerT.EthProcess(testPt)
+	if other.PktRoam(ct, Dummy{nil}) {
+		t.Fatal("roamed with foreign key")
+	}
+	if other.FramesUnauth != 0 {
+		t.Fatal("unauthenticated roaming attempt counted")
+	}
+	if !peerR.PktRoam(ct, Dummy{nil}) {
+		t.Fatal("fresh packet rejected")
+	}
+	if peerR.PktProcess(ct, Dummy{nil}, true) {
+		t.Fatal("roaming packet accepted twice")
+	}
+	peerR.Roam("bar", Dummy{nil})
+	if peerR.Addr != "bar" || peerR.Roams != 1 {
+		t.Fatal("peer is not moved")
+	}
+}
+
+// Peers not negotiated Feistel network nonces still get reordering and
+// replay protection, but only within the window ahead of the latest
+// received packet.
+func TestTransportLegacy(t *testing.T) {
+	conf := *testConf
+	conf.Feistel = false
+	var ct []byte
+	peerT := newPeer(true, "foo", Dummy{&ct}, &conf, new([SSize]byte))
+	peerR := newPeer(false, "foo", Dummy{nil}, &conf, new([SSize]byte))
+	pkts := make([][]byte, 3*ReplayWindowDefault)
+	for i := 0; i < len(pkts); i++ {
+		peerT.EthProcess(testPt)
+		pkts[i] = append([]byte{}, ct...)
+	}
+	if !peerR.PktProcess(pkts[1], Dummy{nil}, true) ||
+		!peerR.PktProcess(pkts[0], Dummy{nil}, true) {
+		t.Fatal("rejected reordered")
+	}
+	if peerR.PktProcess(pkts[1], Dummy{nil}, true) {
+		t.Fatal("accepted replayed")
+	}
+	if peerR.PktProcess(pkts[len(pkts)-1], Dummy{nil}, true) {
+		t.Fatal("accepted too far ahead")
+	}
+	for i := 2; i < len(pkts); i++ {
+		if !peerR.PktProcess(pkts[i], Dummy{nil}, true) {
+			t.Fatal("rejected", i)
+		}
+	}
+	if peerR.PktProcess(pkts[0], Dummy{nil}, true) {
+		t.Fatal("accepted too old")
+	}
+	if len(peerR.rx.legacy) > 2*ReplayWindowDefault+1 {
+		t.Fatal("legacy nonces are not forgotten", len(peerR.rx.legacy))
+	}
+	peerR.Zero()
+	peerT.Zero()
+}
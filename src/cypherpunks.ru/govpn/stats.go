@@ -19,6 +19,7 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
 	"net"
@@ -36,11 +37,15 @@ type KnownPeers map[string]**Peer
 // information about known peers in serialized JSON format. peers
 // argument is a reference to the map with references to the peers as
 // values. Map is used here because of ease of adding and removing
-// elements in it.
-func StatsProcessor(statsPort net.Listener, peers *KnownPeers) {
+// elements in it. If optional counters are specified, then they are
+// shown instead of peers when /counters path is requested. /metrics
+// path shows peers' counters (and counters, if they are MetricsWriter)
+// in Prometheus format.
+func StatsProcessor(statsPort net.Listener, peers *KnownPeers, counters interface{}) {
 	var conn net.Conn
 	var err error
 	var data []byte
+	var n int
 	buf := make([]byte, 2<<8)
 	for {
 		conn, err = statsPort.Accept()
@@ -49,13 +54,28 @@ func StatsProcessor(statsPort net.Listener, peers *KnownPeers) {
 			continue
 		}
 		conn.SetDeadline(time.Now().Add(RWTimeout))
-		conn.Read(buf)
-		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: application/json\r\n\r\n"))
+		n, _ = conn.Read(buf)
 		var peersList []*Peer
 		for _, peer := range *peers {
 			peersList = append(peersList, *peer)
 		}
-		data, err = json.Marshal(peersList)
+		if bytes.HasPrefix(buf[:n], []byte("GET /metrics ")) {
+			conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: " + MetricsContentType + "\r\n\r\n"))
+			var metrics bytes.Buffer
+			PeersMetricsWrite(&metrics, peersList)
+			if mw, ok := counters.(MetricsWriter); ok {
+				mw.MetricsWrite(&metrics)
+			}
+			conn.Write(metrics.Bytes())
+			conn.Close()
+			continue
+		}
+		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: application/json\r\n\r\n"))
+		if counters != nil && bytes.HasPrefix(buf[:n], []byte("GET /counters ")) {
+			data, err = json.Marshal(counters)
+		} else {
+			data, err = json.Marshal(peersList)
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,186 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// Transport's cipher suite. It is negotiated during the handshake:
+// client proposes it, server checks if it is allowed for that peer.
+// Handshake itself is always encrypted with Salsa20.
+type Suite byte
+
+const (
+	SuiteSalsa20Poly1305 Suite = iota
+	SuiteChaCha20Poly1305
+	SuiteXChaCha20Poly1305
+
+	suitesNum = 3
+)
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteSalsa20Poly1305:
+		return "salsa20poly1305"
+	case SuiteChaCha20Poly1305:
+		return "chacha20poly1305"
+	case SuiteXChaCha20Poly1305:
+		return "xchacha20poly1305"
+	}
+	return "unknown"
+}
+
+func (s Suite) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// Parse suite's textual representation. Empty string means default
+// Salsa20-Poly1305 suite.
+func SuiteFromString(str string) (Suite, error) {
+	if str == "" {
+		return SuiteSalsa20Poly1305, nil
+	}
+	for s := Suite(0); s < suitesNum; s++ {
+		if s.String() == str {
+			return s, nil
+		}
+	}
+	return SuiteSalsa20Poly1305, errors.New("Unknown suite: " + str)
+}
+
+// Create AEAD of that suite with the given key. Transport uses 64-bit
+// nonces: they are prepended with zeros up to AEAD's nonce size.
+func (s Suite) AEAD(key *[SSize]byte) (cipher.AEAD, error) {
+	switch s {
+	case SuiteSalsa20Poly1305:
+		return newSalsa20Poly1305(key), nil
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key[:])
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	}
+	return nil, errors.New("Unknown suite")
+}
+
+// Same as AEAD, but panics on unknown suite. Suites are checked while
+// parsing configuration and negotiating in the handshake.
+func (s Suite) newAEAD(key *[SSize]byte) cipher.AEAD {
+	aead, err := s.AEAD(key)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// Is that suite allowed by the configuration. If no suites are
+// explicitly specified, then any known one is allowed.
+func (pc *PeerConf) SuiteAllowed(s Suite) bool {
+	if len(pc.Suites) == 0 {
+		return s < suitesNum
+	}
+	for _, allowed := range pc.Suites {
+		if allowed == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Original GoVPN's transport encryption: Salsa20 with the 64-bit nonce.
+// The first 32 bytes of its keystream are used as one-time Poly1305
+// key, ciphertext is XORed with keystream starting from the second
+// block. Poly1305 authenticates ciphertext with nonce and additional
+// data appended. Tag is placed before the ciphertext.
+// It is not safe for concurrent use, dst must not overlap input and
+// the key is referenced, not copied.
+type salsa20Poly1305 struct {
+	key     *[SSize]byte
+	counter [16]byte
+	authKey [32]byte
+	tag     [TagSize]byte
+}
+
+func newSalsa20Poly1305(key *[SSize]byte) *salsa20Poly1305 {
+	return &salsa20Poly1305{key: key}
+}
+
+func (c *salsa20Poly1305) NonceSize() int {
+	return NonceSize
+}
+
+func (c *salsa20Poly1305) Overhead() int {
+	return TagSize
+}
+
+func (c *salsa20Poly1305) init(nonce []byte) {
+	copy(c.counter[:NonceSize], nonce)
+	SliceZero(c.counter[NonceSize:])
+	SliceZero(c.authKey[:])
+	salsa.XORKeyStream(c.authKey[:], c.authKey[:], &c.counter, c.key)
+	c.counter[NonceSize] = 1
+}
+
+func (c *salsa20Poly1305) mac(ciphertext, nonce, additionalData []byte) {
+	mac := poly1305.New(&c.authKey)
+	mac.Write(ciphertext)
+	mac.Write(nonce)
+	mac.Write(additionalData)
+	mac.Sum(c.tag[:0])
+}
+
+func (c *salsa20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ret, out := sliceForAppend(dst, TagSize+len(plaintext))
+	c.init(nonce)
+	salsa.XORKeyStream(out[TagSize:], plaintext, &c.counter, c.key)
+	c.mac(out[TagSize:], nonce, additionalData)
+	copy(out, c.tag[:])
+	return ret
+}
+
+func (c *salsa20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < TagSize {
+		return nil, errors.New("Too short ciphertext")
+	}
+	c.init(nonce)
+	c.mac(ciphertext[TagSize:], nonce, additionalData)
+	if subtle.ConstantTimeCompare(c.tag[:], ciphertext[:TagSize]) != 1 {
+		return nil, errors.New("Authentication failed")
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext)-TagSize)
+	salsa.XORKeyStream(out, ciphertext[TagSize:], &c.counter, c.key)
+	return ret, nil
+}
+
+func sliceForAppend(in []byte, n int) ([]byte, []byte) {
+	var head []byte
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	return head, head[len(in):]
+}
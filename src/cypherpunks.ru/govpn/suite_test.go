@@ -0,0 +1,152 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"testing/quick"
+
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/salsa20"
+)
+
+func TestSuiteChaCha20Poly1305Vector(t *testing.T) {
+	// RFC 7539, section 2.8.2
+	key := new([SSize]byte)
+	for i := 0; i < SSize; i++ {
+		key[i] = byte(0x80 + i)
+	}
+	nonce, _ := hex.DecodeString("070000004041424344454647")
+	ad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	pt := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	expected, _ := hex.DecodeString(
+		"d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+			"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+			"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+			"3ff4def08e4b7a9de576d26586cec64b6116" +
+			"1ae10b594f09e26a7e902ecbd0600691",
+	)
+	aead, err := SuiteChaCha20Poly1305.AEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := aead.Seal(nil, nonce, pt, ad)
+	if bytes.Compare(ct, expected) != 0 {
+		t.Fatalf("%x", ct)
+	}
+	dec, err := aead.Open(nil, nonce, ct, ad)
+	if err != nil || bytes.Compare(dec, pt) != 0 {
+		t.Fail()
+	}
+}
+
+// Salsa20-Poly1305 suite must be the same as original transport's
+// encryption: block-sized Salsa20 prefix is Poly1305's key.
+func TestSuiteSalsa20Poly1305Legacy(t *testing.T) {
+	key := new([SSize]byte)
+	key[0] = 1
+	aead := newSalsa20Poly1305(key)
+	nonce := []byte("12345678")
+	f := func(pt []byte) bool {
+		buf := make([]byte, S20BS+len(pt))
+		copy(buf[S20BS:], pt)
+		salsa20.XORKeyStream(buf, buf, nonce, key)
+		authKey := new([32]byte)
+		copy(authKey[:], buf[:32])
+		tag := new([TagSize]byte)
+		poly1305.Sum(tag, append(buf[S20BS:], nonce...), authKey)
+		expected := append(tag[:], buf[S20BS:]...)
+		if bytes.Compare(aead.Seal(nil, nonce, pt, nil), expected) != 0 {
+			return false
+		}
+		dec, err := aead.Open(nil, nonce, expected, nil)
+		return err == nil && bytes.Compare(dec, pt) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransportSymmetricSuites(t *testing.T) {
+	for _, suite := range []Suite{
+		SuiteChaCha20Poly1305,
+		SuiteXChaCha20Poly1305,
+	} {
+		testConf.Suite = suite
+		var ct []byte
+		peer := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+		peerd := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+		f := func(payload []byte) bool {
+			if len(payload) == 0 {
+				return true
+			}
+			peer.EthProcess(payload)
+			if !peerd.PktProcess(ct, Dummy{nil}, true) {
+				return false
+			}
+			ct[0] ^= 1
+			return !peerd.PktProcess(ct, Dummy{nil}, true)
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Error(suite, err)
+		}
+	}
+	testConf.Suite = SuiteSalsa20Poly1305
+}
+
+func TestHandshakeSuite(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	testConf.Suite = SuiteXChaCha20Poly1305
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	peerS := hsS.Server(testCt)
+	if peerS == nil || peerS.Suite != SuiteXChaCha20Poly1305 {
+		t.Fail()
+	}
+	peerC := hsC.Client(testCt)
+	if peerC == nil || peerC.Suite != SuiteXChaCha20Poly1305 {
+		t.Fail()
+	}
+	testConf.Suite = SuiteSalsa20Poly1305
+}
+
+func TestHandshakeSuiteNotAllowed(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	confS := *testConf
+	confS.Suites = []Suite{SuiteSalsa20Poly1305}
+	testConf.Suite = SuiteChaCha20Poly1305
+	hsS := NewHandshake("server", Dummy{&testCt}, &confS)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if hsS.Server(testCt) != nil {
+		t.Fail()
+	}
+	testConf.Suite = SuiteSalsa20Poly1305
+}
@@ -0,0 +1,205 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// How long learnt MAC address is kept in forwarding table
+	SwitchAgingTime = 5 * time.Minute
+	// Queue length of each switch's port
+	SwitchPortQueue = 1 << 7
+
+	macSize = 6
+)
+
+type macEntry struct {
+	port *TAP
+	seen time.Time
+}
+
+// Virtual Ethernet switch. Each peer attached to it gets its own port,
+// that looks like an ordinary TAP interface: frames written to it are
+// forwarded to other ports, and frames destined to it appear in its
+// Sink. Optional uplink TAP interface is an ordinary port too.
+type Switch struct {
+	Name   string
+	uplink *TAP
+	ports  map[*TAP]struct{}
+	macs   map[[macSize]byte]*macEntry
+	l      sync.Mutex
+	closed chan struct{}
+}
+
+type switchPort struct {
+	sw   *Switch
+	port *TAP
+}
+
+func (sp switchPort) Write(data []byte) (int, error) {
+	sp.sw.Forward(sp.port, data)
+	return len(data), nil
+}
+
+// Port's frames are delivered through TAP's Sink, not read directly.
+func (sp switchPort) Read(data []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Port is detached with PortDel, there is nothing to close.
+func (sp switchPort) Close() error {
+	return nil
+}
+
+// Create new switch with optional uplink interface.
+func NewSwitch(name string, uplink *TAP) *Switch {
+	s := Switch{
+		Name:   name,
+		uplink: uplink,
+		ports:  make(map[*TAP]struct{}),
+		macs:   make(map[[macSize]byte]*macEntry),
+		closed: make(chan struct{}),
+	}
+	if uplink != nil {
+		s.ports[uplink] = struct{}{}
+		go func() {
+			for {
+				select {
+				case data := <-uplink.Sink:
+					s.Forward(uplink, data)
+				case <-s.closed:
+					return
+				}
+			}
+		}()
+	}
+	return &s
+}
+
+// Switch's uplink interface, nil if there is none.
+func (s *Switch) Uplink() *TAP {
+	return s.uplink
+}
+
+// Stop forwarding frames from the uplink. Uplink interface itself is
+// not closed: it is released by the one who opened it.
+func (s *Switch) Close() {
+	close(s.closed)
+}
+
+// Attach new port to the switch.
+func (s *Switch) PortAdd() *TAP {
+	port := &TAP{
+		Name: s.Name,
+		Mode: ModeTAP,
+		Sink: make(chan []byte, SwitchPortQueue),
+	}
+	port.dev = switchPort{s, port}
+	s.l.Lock()
+	s.ports[port] = struct{}{}
+	s.l.Unlock()
+	return port
+}
+
+// Detach the port from the switch, forgetting all MAC addresses learnt
+// on it.
+func (s *Switch) PortDel(port *TAP) {
+	s.l.Lock()
+	delete(s.ports, port)
+	for mac, entry := range s.macs {
+		if entry.port == port {
+			delete(s.macs, mac)
+		}
+	}
+	s.l.Unlock()
+}
+
+// Quantity of attached ports, including uplink.
+func (s *Switch) PortsNum() int {
+	s.l.Lock()
+	n := len(s.ports)
+	s.l.Unlock()
+	return n
+}
+
+// Forget MAC addresses not seen since SwitchAgingTime.
+func (s *Switch) Age(now time.Time) {
+	s.l.Lock()
+	for mac, entry := range s.macs {
+		if entry.seen.Add(SwitchAgingTime).Before(now) {
+			delete(s.macs, mac)
+		}
+	}
+	s.l.Unlock()
+}
+
+func (s *Switch) send(port *TAP, frame []byte) {
+	if port == s.uplink {
+		port.Write(frame)
+		return
+	}
+	select {
+	case port.Sink <- frame:
+	default:
+		// Port's queue is full: drop the frame
+	}
+}
+
+// Learn frame's source MAC address and forward it either to the known
+// destination's port, or flood it to all ports except the ingress one.
+func (s *Switch) Forward(ingress *TAP, data []byte) {
+	if len(data) < EtherSize {
+		return
+	}
+	// Frame's buffer can be reused by the caller after return
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	var dst, src [macSize]byte
+	copy(dst[:], frame[:macSize])
+	copy(src[:], frame[macSize:2*macSize])
+	now := time.Now()
+	s.l.Lock()
+	if src[0]&1 == 0 {
+		if entry, exists := s.macs[src]; exists {
+			entry.port = ingress
+			entry.seen = now
+		} else {
+			s.macs[src] = &macEntry{port: ingress, seen: now}
+		}
+	}
+	if dst[0]&1 == 0 {
+		if entry, exists := s.macs[dst]; exists {
+			if entry.port != ingress {
+				s.send(entry.port, frame)
+			}
+			s.l.Unlock()
+			return
+		}
+	}
+	for port := range s.ports {
+		if port != ingress {
+			s.send(port, frame)
+		}
+	}
+	s.l.Unlock()
+}
@@ -0,0 +1,109 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func testFrame(dst, src byte) []byte {
+	frame := make([]byte, EtherSize+4)
+	for i := 0; i < macSize; i++ {
+		frame[i] = dst
+		frame[macSize+i] = src
+	}
+	return frame
+}
+
+func testSinkGot(port *TAP) []byte {
+	select {
+	case frame := <-port.Sink:
+		return frame
+	default:
+	}
+	return nil
+}
+
+func TestSwitchFlooding(t *testing.T) {
+	sw := NewSwitch("sw0", nil)
+	p1 := sw.PortAdd()
+	p2 := sw.PortAdd()
+	p3 := sw.PortAdd()
+	frame := testFrame(0xFF, 0x02)
+	p1.Write(frame)
+	if testSinkGot(p1) != nil {
+		t.Fatal("frame returned to ingress port")
+	}
+	for _, port := range []*TAP{p2, p3} {
+		if got := testSinkGot(port); bytes.Compare(got, frame) != 0 {
+			t.Fatal("broadcast frame is not flooded")
+		}
+	}
+}
+
+func TestSwitchLearning(t *testing.T) {
+	sw := NewSwitch("sw0", nil)
+	p1 := sw.PortAdd()
+	p2 := sw.PortAdd()
+	p3 := sw.PortAdd()
+	p1.Write(testFrame(0xFF, 0x02))
+	testSinkGot(p2)
+	testSinkGot(p3)
+	p2.Write(testFrame(0x02, 0x04))
+	if testSinkGot(p1) == nil {
+		t.Fatal("frame is not forwarded to learnt port")
+	}
+	if testSinkGot(p3) != nil {
+		t.Fatal("frame to learnt address is flooded")
+	}
+	sw.Age(time.Now().Add(2 * SwitchAgingTime))
+	p2.Write(testFrame(0x02, 0x04))
+	if testSinkGot(p1) == nil || testSinkGot(p3) == nil {
+		t.Fatal("aged address is not flooded")
+	}
+	sw.PortDel(p1)
+	p2.Write(testFrame(0x02, 0x04))
+	if testSinkGot(p1) != nil {
+		t.Fatal("frame is forwarded to deleted port")
+	}
+}
+
+func TestSwitchUplinkClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	dev := newTestTAPDev()
+	uplink := newTAP("test3", MTUDefault, ModeTAP, dev)
+	sw := NewSwitch("sw0", uplink)
+	if sw.Uplink() != uplink {
+		t.Fatal("uplink is not remembered")
+	}
+	p1 := sw.PortAdd()
+	dev.pkts <- testFrame(0xFF, 0x02)
+	select {
+	case <-p1.Sink:
+	case <-time.After(time.Second):
+		t.Fatal("uplink's frame is not forwarded")
+	}
+	sw.PortDel(p1)
+	sw.Close()
+	uplink.Close()
+	goroutinesWait(t, before)
+}
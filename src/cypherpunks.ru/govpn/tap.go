@@ -19,28 +19,43 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"errors"
 	"io"
+	"log"
+	"sync"
 )
 
 type TAP struct {
 	Name string
+	Mode Mode
 	Sink chan []byte
-	dev  io.ReadWriter
+	dev  io.ReadWriteCloser
+
+	// Number of peers using that interface, guarded by tapsLock
+	refs   int
+	closed chan struct{}
 }
 
 var (
-	taps = make(map[string]*TAP)
+	taps     = make(map[string]*TAP)
+	tapsLock sync.Mutex
 )
 
-func NewTAP(ifaceName string, mtu int) (*TAP, error) {
-	tapRaw, err := newTAPer(ifaceName)
+func NewTAP(ifaceName string, mtu int, mode Mode) (*TAP, error) {
+	tapRaw, err := newTAPer(ifaceName, mode)
 	if err != nil {
 		return nil, err
 	}
+	return newTAP(ifaceName, mtu, mode, tapRaw), nil
+}
+
+func newTAP(ifaceName string, mtu int, mode Mode, dev io.ReadWriteCloser) *TAP {
 	tap := TAP{
-		Name: ifaceName,
-		dev:  tapRaw,
-		Sink: make(chan []byte),
+		Name:   ifaceName,
+		Mode:   mode,
+		dev:    dev,
+		Sink:   make(chan []byte),
+		closed: make(chan struct{}),
 	}
 	go func() {
 		var n int
@@ -58,27 +73,68 @@ func NewTAP(ifaceName string, mtu int) (*TAP, error) {
 			bufZ = !bufZ
 			n, err = tap.dev.Read(buf)
 			if err != nil {
-				panic("Reading TAP:" + err.Error())
+				select {
+				case <-tap.closed:
+				default:
+					log.Println("Reading TAP", tap.Name, "failed:", err)
+				}
+				return
+			}
+			select {
+			case tap.Sink <- buf[:n]:
+			case <-tap.closed:
+				return
 			}
-			tap.Sink <- buf[:n]
 		}
 	}()
-	return &tap, nil
+	return &tap
 }
 
 func (t *TAP) Write(data []byte) (n int, err error) {
 	return t.dev.Write(data)
 }
 
-func TAPListen(ifaceName string, mtu int) (*TAP, error) {
+// Close the interface and stop its reading goroutine.
+func (t *TAP) Close() error {
+	close(t.closed)
+	return t.dev.Close()
+}
+
+// Get already opened TAP/TUN interface or open the new one. Interface
+// can not be shared between different modes. Each successful call must
+// be paired with TAPRelease.
+func TAPListen(ifaceName string, mtu int, mode Mode) (*TAP, error) {
+	tapsLock.Lock()
+	defer tapsLock.Unlock()
 	tap, exists := taps[ifaceName]
 	if exists {
+		if tap.Mode != mode {
+			return nil, errors.New("Interface " + ifaceName + " is already opened in " + tap.Mode.String() + " mode")
+		}
+		tap.refs++
 		return tap, nil
 	}
-	tap, err := NewTAP(ifaceName, mtu)
+	tap, err := NewTAP(ifaceName, mtu, mode)
 	if err != nil {
 		return nil, err
 	}
+	tap.refs = 1
 	taps[ifaceName] = tap
 	return tap, nil
 }
+
+// Release interface got with TAPListen. It is closed when the last user
+// releases it, so the next TAPListen opens it again.
+func TAPRelease(tap *TAP) error {
+	tapsLock.Lock()
+	defer tapsLock.Unlock()
+	if taps[tap.Name] != tap {
+		return errors.New("Interface " + tap.Name + " is not opened")
+	}
+	tap.refs--
+	if tap.refs > 0 {
+		return nil
+	}
+	delete(taps, tap.Name)
+	return tap.Close()
+}
@@ -13,6 +13,8 @@ import (
 	"path"
 )
 
-func newTAPer(ifaceName string) (io.ReadWriter, error) {
+// Both TAP and TUN devices are just character devices under /dev, so
+// interface name itself tells what mode is used.
+func newTAPer(ifaceName string, mode Mode) (io.ReadWriteCloser, error) {
 	return os.OpenFile(path.Join("/dev/", ifaceName), os.O_RDWR, os.ModePerm)
 }
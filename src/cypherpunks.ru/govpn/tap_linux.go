@@ -9,10 +9,47 @@ package govpn
 
 import (
 	"io"
-
-	"github.com/bigeagle/water"
+	"os"
+	"syscall"
+	"unsafe"
 )
 
-func newTAPer(ifaceName string) (io.ReadWriter, error) {
-	return water.NewTAP(ifaceName)
+const tunClonePath = "/dev/net/tun"
+
+// struct ifreq with ifr_flags member of the union
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [24 - 2]byte
+}
+
+// Attach to the TAP/TUN interface through the clone device. It is
+// opened in non-blocking mode, so closing the file interrupts reading
+// from it.
+func newTAPer(ifaceName string, mode Mode) (io.ReadWriteCloser, error) {
+	fd, err := syscall.Open(
+		tunClonePath,
+		syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC,
+		0,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ifr ifreqFlags
+	copy(ifr.name[:syscall.IFNAMSIZ-1], ifaceName)
+	ifr.flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	if mode == ModeTUN {
+		ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(syscall.TUNSETIFF),
+		uintptr(unsafe.Pointer(&ifr)),
+	)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	return os.NewFile(uintptr(fd), tunClonePath), nil
 }
@@ -0,0 +1,42 @@
+// +build linux freebsd
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package govpn
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// struct ifreq with ifr_mtu member of the union
+type ifreqMTU struct {
+	name [syscall.IFNAMSIZ]byte
+	mtu  int32
+	_    [24 - 4]byte
+}
+
+// Set interface's MTU.
+func (t *TAP) MTUSet(mtu int) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr ifreqMTU
+	copy(ifr.name[:syscall.IFNAMSIZ-1], t.Name)
+	ifr.mtu = int32(mtu)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(syscall.SIOCSIFMTU),
+		uintptr(unsafe.Pointer(&ifr)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Device returning packets from the channel until it is closed.
+type testTAPDev struct {
+	pkts   chan []byte
+	closed chan struct{}
+}
+
+func newTestTAPDev() *testTAPDev {
+	return &testTAPDev{make(chan []byte), make(chan struct{})}
+}
+
+func (d *testTAPDev) Read(b []byte) (int, error) {
+	select {
+	case pkt, ok := <-d.pkts:
+		if !ok {
+			return 0, errors.New("device is gone")
+		}
+		return copy(b, pkt), nil
+	case <-d.closed:
+		return 0, errors.New("closed")
+	}
+}
+
+func (d *testTAPDev) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *testTAPDev) Close() error {
+	close(d.closed)
+	return nil
+}
+
+func goroutinesWait(t *testing.T, n int) {
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("goroutines are left", runtime.NumGoroutine(), n)
+}
+
+func TestTAPRefcount(t *testing.T) {
+	before := runtime.NumGoroutine()
+	dev := newTestTAPDev()
+	tap := newTAP("test0", MTUDefault, ModeTAP, dev)
+	tapsLock.Lock()
+	tap.refs = 1
+	taps[tap.Name] = tap
+	tapsLock.Unlock()
+	if again, err := TAPListen(tap.Name, MTUDefault, ModeTAP); err != nil || again != tap {
+		t.Fatal("opened interface is not reused")
+	}
+	if _, err := TAPListen(tap.Name, MTUDefault, ModeTUN); err == nil {
+		t.Fatal("mode mismatch is not detected")
+	}
+	dev.pkts <- []byte("foo")
+	if string(<-tap.Sink) != "foo" {
+		t.Fatal("packet is not read")
+	}
+	if err := TAPRelease(tap); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dev.closed:
+		t.Fatal("closed while still used")
+	default:
+	}
+	if err := TAPRelease(tap); err != nil {
+		t.Fatal(err)
+	}
+	<-dev.closed
+	goroutinesWait(t, before)
+	if err := TAPRelease(tap); err == nil {
+		t.Fatal("released twice")
+	}
+}
+
+func TestTAPReadError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	dev := newTestTAPDev()
+	newTAP("test1", MTUDefault, ModeTAP, dev)
+	close(dev.pkts)
+	goroutinesWait(t, before)
+}
+
+func TestTAPCloseNotConsumed(t *testing.T) {
+	before := runtime.NumGoroutine()
+	dev := newTestTAPDev()
+	tap := newTAP("test2", MTUDefault, ModeTAP, dev)
+	// Reader is blocked on passing the packet nobody takes
+	dev.pkts <- []byte("foo")
+	tap.Close()
+	goroutinesWait(t, before)
+}
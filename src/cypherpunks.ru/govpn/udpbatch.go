@@ -0,0 +1,43 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"net"
+)
+
+const (
+	// Maximal number of datagrams read or written at once
+	UDPBatchSize = 1 << 5
+)
+
+// Single datagram of the batch. Buf is the whole buffer for reading,
+// N is the size of received or sent data. Addr is the remote's address,
+// nil for connected sockets when writing.
+type UDPMsg struct {
+	Buf  []byte
+	N    int
+	Addr *net.UDPAddr
+}
+
+// Connection able to send several packets at once. Peer uses it to
+// send bursts of TAP interface's packets.
+type BatchWriter interface {
+	WriteBatch(pkts [][]byte) error
+}
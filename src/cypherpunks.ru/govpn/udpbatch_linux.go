@@ -0,0 +1,81 @@
+// +build linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package govpn
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Batched UDP I/O using recvmmsg/sendmmsg system calls.
+type UDPBatch struct {
+	conn batchConn
+	msgs []ipv4.Message
+}
+
+func NewUDPBatch(conn *net.UDPConn) *UDPBatch {
+	b := UDPBatch{msgs: make([]ipv4.Message, UDPBatchSize)}
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() != nil {
+		b.conn = ipv4.NewPacketConn(conn)
+	} else {
+		b.conn = ipv6.NewPacketConn(conn)
+	}
+	for i := 0; i < len(b.msgs); i++ {
+		b.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return &b
+}
+
+// Read up to len(msgs) datagrams, at least one.
+func (b *UDPBatch) Read(msgs []UDPMsg) (int, error) {
+	if len(msgs) > len(b.msgs) {
+		msgs = msgs[:len(b.msgs)]
+	}
+	ms := b.msgs[:len(msgs)]
+	for i := 0; i < len(msgs); i++ {
+		ms[i].Buffers[0] = msgs[i].Buf
+	}
+	n, err := b.conn.ReadBatch(ms, 0)
+	for i := 0; i < n; i++ {
+		msgs[i].N = ms[i].N
+		msgs[i].Addr, _ = ms[i].Addr.(*net.UDPAddr)
+	}
+	return n, err
+}
+
+// Write all datagrams.
+func (b *UDPBatch) Write(msgs []UDPMsg) error {
+	for len(msgs) > 0 {
+		ms := b.msgs
+		if len(msgs) < len(ms) {
+			ms = ms[:len(msgs)]
+		}
+		for i := 0; i < len(ms); i++ {
+			ms[i].Buffers[0] = msgs[i].Buf[:msgs[i].N]
+			// Typed nil pointer must not get into the interface
+			if msgs[i].Addr == nil {
+				ms[i].Addr = nil
+			} else {
+				ms[i].Addr = msgs[i].Addr
+			}
+		}
+		n, err := b.conn.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// +build !linux
+
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+*/
+
+package govpn
+
+import (
+	"net"
+)
+
+// Portable UDP I/O: single datagram per system call.
+type UDPBatch struct {
+	conn *net.UDPConn
+}
+
+func NewUDPBatch(conn *net.UDPConn) *UDPBatch {
+	return &UDPBatch{conn}
+}
+
+// Read single datagram.
+func (b *UDPBatch) Read(msgs []UDPMsg) (int, error) {
+	n, addr, err := b.conn.ReadFromUDP(msgs[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N = n
+	msgs[0].Addr = addr
+	return 1, nil
+}
+
+// Write all datagrams one by one.
+func (b *UDPBatch) Write(msgs []UDPMsg) error {
+	var err error
+	for _, msg := range msgs {
+		if msg.Addr == nil {
+			_, err = b.conn.Write(msg.Buf[:msg.N])
+		} else {
+			_, err = b.conn.WriteToUDP(msg.Buf[:msg.N], msg.Addr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
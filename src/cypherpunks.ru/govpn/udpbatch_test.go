@@ -0,0 +1,115 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type batchRecorder struct {
+	batches [][][]byte
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	r.batches = append(r.batches, [][]byte{append([]byte{}, b...)})
+	return len(b), nil
+}
+
+func (r *batchRecorder) WriteBatch(pkts [][]byte) error {
+	batch := make([][]byte, 0, len(pkts))
+	for _, pkt := range pkts {
+		batch = append(batch, append([]byte{}, pkt...))
+	}
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+func TestUDPBatchLoopback(t *testing.T) {
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cln, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cln.Close()
+	msgs := make([]UDPMsg, UDPBatchSize/2)
+	for i := 0; i < len(msgs); i++ {
+		msgs[i].Buf = bytes.Repeat([]byte{byte(i)}, i+1)
+		msgs[i].N = i + 1
+	}
+	if err = NewUDPBatch(cln).Write(msgs); err != nil {
+		t.Fatal(err)
+	}
+	recv := make([]UDPMsg, UDPBatchSize)
+	for i := 0; i < len(recv); i++ {
+		recv[i].Buf = make([]byte, MTUMax)
+	}
+	batch := NewUDPBatch(srv)
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got int
+	for got < len(msgs) {
+		n, err := batch.Read(recv[:len(msgs)-got])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(recv[i].Buf[:recv[i].N], msgs[got].Buf) {
+				t.Fatal("datagram differs", got)
+			}
+			if recv[i].Addr.String() != cln.LocalAddr().String() {
+				t.Fatal("source address differs", recv[i].Addr)
+			}
+			got++
+		}
+	}
+}
+
+func TestEthProcessBurst(t *testing.T) {
+	rec := new(batchRecorder)
+	peerT := newPeer(true, "foo", rec, testConf, new([SSize]byte))
+	peerR := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	sink := make(chan []byte, UDPBatchSize*2)
+	for i := 0; i < cap(sink); i++ {
+		sink <- bytes.Repeat([]byte{byte(i)}, 100)
+	}
+	peerT.ethProcessBurst(testPt, sink)
+	peerT.ethProcessBurst(testPt, sink)
+	if len(rec.batches) != 2 {
+		t.Fatal("batches count", len(rec.batches))
+	}
+	for _, batch := range rec.batches {
+		if len(batch) != UDPBatchSize {
+			t.Fatal("batch size", len(batch))
+		}
+		for _, pkt := range batch {
+			if !peerR.PktProcess(pkt, Dummy{nil}, true) {
+				t.Fatal("unauthenticated")
+			}
+		}
+	}
+	if len(sink) != 2 {
+		t.Fatal("unexpected sink length", len(sink))
+	}
+}
@@ -29,7 +29,9 @@ import (
 	"strings"
 
 	"github.com/agl/ed25519"
+	"github.com/agl/ed25519/edwards25519"
 	"github.com/magical/argon2"
+	xargon2 "golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -37,9 +39,13 @@ const (
 	DefaultM = 1 << 12
 	DefaultT = 1 << 7
 	DefaultP = 1
+
+	AlgArgon2d  = "argon2d"
+	AlgArgon2id = "argon2id"
 )
 
 type Verifier struct {
+	Alg string
 	M   int
 	T   int
 	P   int
@@ -48,17 +54,40 @@ type Verifier struct {
 }
 
 // Generate new verifier for given peer, with specified password and
-// hashing parameters.
+// hashing parameters. Argon2d is used by default.
 func VerifierNew(m, t, p int, id *PeerId) *Verifier {
-	return &Verifier{M: m, T: t, P: p, Id: id}
+	return &Verifier{Alg: AlgArgon2d, M: m, T: t, P: p, Id: id}
+}
+
+// Check that hashing algorithm is known and its parameters are valid.
+func (v *Verifier) Validate() error {
+	switch v.Alg {
+	case AlgArgon2d:
+	case AlgArgon2id:
+		if v.P > 255 {
+			return errors.New("Too big Argon2id parallelizm parameter")
+		}
+	default:
+		return errors.New("Unknown verifier algorithm: " + v.Alg)
+	}
+	if v.M <= 0 || v.T <= 0 || v.P <= 0 {
+		return errors.New("Invalid verifier parameters")
+	}
+	return nil
 }
 
 // Apply the password: create Ed25519 keypair based on it, save public
 // key in verifier.
 func (v *Verifier) PasswordApply(password string) *[ed25519.PrivateKeySize]byte {
-	r, err := argon2.Key([]byte(password), v.Id[:], v.T, v.P, int64(v.M), 32)
-	if err != nil {
-		log.Fatalln("Unable to apply Argon2d", err)
+	var r []byte
+	var err error
+	if v.Alg == AlgArgon2id {
+		r = xargon2.IDKey([]byte(password), v.Id[:], uint32(v.T), uint32(v.M), uint8(v.P), 32)
+	} else {
+		r, err = argon2.Key([]byte(password), v.Id[:], v.T, v.P, int64(v.M), 32)
+		if err != nil {
+			log.Fatalln("Unable to apply Argon2d", err)
+		}
 	}
 	defer SliceZero(r)
 	src := bytes.NewBuffer(r)
@@ -73,7 +102,7 @@ func (v *Verifier) PasswordApply(password string) *[ed25519.PrivateKeySize]byte
 // Parse either short or long verifier form.
 func VerifierFromString(input string) (*Verifier, error) {
 	s := strings.Split(input, "$")
-	if len(s) < 4 || s[1] != "argon2d" {
+	if len(s) < 4 || (s[1] != AlgArgon2d && s[1] != AlgArgon2id) {
 		return nil, errors.New("Invalid verifier structure")
 	}
 	var m, t, p int
@@ -85,7 +114,13 @@ func VerifierFromString(input string) (*Verifier, error) {
 	if err != nil {
 		return nil, err
 	}
-	v := Verifier{M: m, T: t, P: p}
+	if len(salt) != IDSize {
+		return nil, errors.New("Invalid verifier salt length")
+	}
+	v := Verifier{Alg: s[1], M: m, T: t, P: p}
+	if err = v.Validate(); err != nil {
+		return nil, err
+	}
 	id := new([IDSize]byte)
 	copy(id[:], salt)
 	pid := PeerId(*id)
@@ -95,18 +130,34 @@ func VerifierFromString(input string) (*Verifier, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid verifier public key length")
+		}
 		v.Pub = new([ed25519.PublicKeySize]byte)
 		copy(v.Pub[:], pub)
 	}
 	return &v, nil
 }
 
+// Check that verifier has the public key and it is the valid curve
+// point. Only long form verifiers, used by the server, have it.
+func (v *Verifier) PubValidate() error {
+	if v.Pub == nil {
+		return errors.New("Verifier has no public key")
+	}
+	var point edwards25519.ExtendedGroupElement
+	if !point.FromBytes(v.Pub) {
+		return errors.New("Invalid verifier public key")
+	}
+	return nil
+}
+
 // Short verifier string form -- it is useful for the client.
 // Does not include public key.
 func (v *Verifier) ShortForm() string {
 	return fmt.Sprintf(
-		"$argon2d$m=%d,t=%d,p=%d$%s",
-		v.M, v.T, v.P, base64.RawStdEncoding.EncodeToString(v.Id[:]),
+		"$%s$m=%d,t=%d,p=%d$%s",
+		v.Alg, v.M, v.T, v.P, base64.RawStdEncoding.EncodeToString(v.Id[:]),
 	)
 }
 
@@ -0,0 +1,94 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifierString(t *testing.T) {
+	for _, alg := range []string{AlgArgon2d, AlgArgon2id} {
+		v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+		v.Alg = alg
+		v.PasswordApply("does not matter")
+		parsed, err := VerifierFromString(v.LongForm())
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		if parsed.Alg != alg || parsed.M != v.M || parsed.T != v.T || parsed.P != v.P {
+			t.Fatal(alg, "parameters differ")
+		}
+		if *parsed.Id != *v.Id || bytes.Compare(parsed.Pub[:], v.Pub[:]) != 0 {
+			t.Fatal(alg, "identity differs")
+		}
+		parsed, err = VerifierFromString(v.ShortForm())
+		if err != nil || parsed.Pub != nil {
+			t.Fatal(alg, "short form")
+		}
+		parsed.PasswordApply("does not matter")
+		if bytes.Compare(parsed.Pub[:], v.Pub[:]) != 0 {
+			t.Fatal(alg, "public key differs")
+		}
+	}
+}
+
+func TestVerifierAlgsDiffer(t *testing.T) {
+	vD := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	vD.PasswordApply("does not matter")
+	vID := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	vID.Alg = AlgArgon2id
+	vID.PasswordApply("does not matter")
+	if bytes.Compare(vD.Pub[:], vID.Pub[:]) == 0 {
+		t.Fail()
+	}
+}
+
+func TestVerifierInvalid(t *testing.T) {
+	for _, s := range []string{
+		"$argon2i$m=1024,t=16,p=1$AAAAAAAAAAAAAAAAAAAAAA",
+		"$argon2id$m=1024,t=16,p=256$AAAAAAAAAAAAAAAAAAAAAA",
+		"$argon2d$m=0,t=16,p=1$AAAAAAAAAAAAAAAAAAAAAA",
+		"$argon2d$m=1024,t=16,p=1$AAAAAAAAAAAAAAAAAAAA",
+		"$argon2d$m=1024,t=16,p=1$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAA",
+	} {
+		if _, err := VerifierFromString(s); err == nil {
+			t.Error(s)
+		}
+	}
+}
+
+func TestVerifierPub(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	if v.PubValidate() == nil {
+		t.Fatal("absent public key is valid")
+	}
+	v.PasswordApply("does not matter")
+	if err := v.PubValidate(); err != nil {
+		t.Fatal(err)
+	}
+	// Roughly half of all y coordinates are not on the curve
+	for i := 0; i < 256; i++ {
+		v.Pub[0] = byte(i)
+		if v.PubValidate() != nil {
+			return
+		}
+	}
+	t.Fatal("invalid public key is not found")
+}
@@ -0,0 +1,298 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 WebSocket implementation: each binary message
+// carries exactly one GoVPN packet.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsFin  = 0x80
+	wsMask = 0x80
+)
+
+var (
+	WSMessageTooBig = errors.New("WebSocket message is too big")
+)
+
+// WebSocket connection with packet semantics: each Write sends single
+// binary message, each Read returns single message.
+type WSConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool
+	wLock  sync.Mutex
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Connect to ws:// or wss:// URL.
+func WSDial(rawurl string) (*WSConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.Trim(u.Host, "[]")
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	dialer := &net.Dialer{Timeout: RWTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	case "wss":
+		conn, err = tls.DialWithDialer(
+			dialer, "tcp", net.JoinHostPort(host, port),
+			&tls.Config{ServerName: host},
+		)
+	default:
+		return nil, errors.New("Unknown WebSocket scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyRaw := make([]byte, 16)
+	if _, err = io.ReadFull(Rand, keyRaw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyRaw)
+	path := u.RequestURI()
+	req := "GET " + path + " HTTP/1.1\r\n"
+	req += "Host: " + u.Host + "\r\n"
+	req += "Upgrade: websocket\r\n"
+	req += "Connection: Upgrade\r\n"
+	req += "Sec-WebSocket-Key: " + key + "\r\n"
+	req += "Sec-WebSocket-Version: 13\r\n\r\n"
+	conn.SetDeadline(time.Now().Add(RWTimeout))
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "GET"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.New("WebSocket upgrade failed: " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &WSConn{Conn: conn, r: r, client: true}, nil
+}
+
+// Upgrade HTTP request to WebSocket connection. Error response is sent
+// if request is not an upgrade one.
+func WSUpgrade(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("Not a WebSocket upgrade request")
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n"
+	resp += "Upgrade: websocket\r\n"
+	resp += "Connection: Upgrade\r\n"
+	resp += "Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WSConn{Conn: conn, r: rw.Reader}, nil
+}
+
+func (c *WSConn) frameWrite(op byte, data []byte) (int, error) {
+	hdr := make([]byte, 2, 2+8+4)
+	hdr[0] = wsFin | op
+	switch {
+	case len(data) < 126:
+		hdr[1] = byte(len(data))
+	case len(data) <= 0xFFFF:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(data)))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(data)))
+	}
+	frame := data
+	if c.client {
+		hdr[1] |= wsMask
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(Rand, mask); err != nil {
+			return 0, err
+		}
+		hdr = append(hdr, mask...)
+		frame = make([]byte, len(data))
+		for i := 0; i < len(data); i++ {
+			frame[i] = data[i] ^ mask[i%4]
+		}
+	}
+	c.wLock.Lock()
+	_, err := c.Conn.Write(append(hdr, frame...))
+	c.wLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Send data as a single binary message.
+func (c *WSConn) Write(data []byte) (int, error) {
+	return c.frameWrite(wsOpBinary, data)
+}
+
+// Read single binary message. Control frames are processed silently.
+// io.EOF is returned after closing frame.
+func (c *WSConn) Read(buf []byte) (int, error) {
+	var hdr [8]byte
+	var mask [4]byte
+	var n int
+	var started bool
+	for {
+		if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+			return 0, err
+		}
+		fin := hdr[0]&wsFin != 0
+		op := hdr[0] & 0x0F
+		masked := hdr[1]&wsMask != 0
+		if masked == c.client {
+			return 0, errors.New("Invalid WebSocket frame masking")
+		}
+		size := uint64(hdr[1] &^ wsMask)
+		switch size {
+		case 126:
+			if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+				return 0, err
+			}
+			size = uint64(binary.BigEndian.Uint16(hdr[:2]))
+		case 127:
+			if _, err := io.ReadFull(c.r, hdr[:8]); err != nil {
+				return 0, err
+			}
+			size = binary.BigEndian.Uint64(hdr[:8])
+		}
+		if masked {
+			if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+				return 0, err
+			}
+		}
+		var payload []byte
+		if op >= wsOpClose {
+			if size > 125 {
+				return 0, errors.New("Too big WebSocket control frame")
+			}
+			payload = make([]byte, size)
+		} else {
+			if size > uint64(len(buf)-n) {
+				return 0, WSMessageTooBig
+			}
+			payload = buf[n : n+int(size)]
+		}
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, err
+		}
+		if masked {
+			for i := 0; i < len(payload); i++ {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch op {
+		case wsOpPing:
+			if _, err := c.frameWrite(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.frameWrite(wsOpClose, nil)
+			return 0, io.EOF
+		case wsOpBinary:
+			if started {
+				return 0, errors.New("Unexpected WebSocket message start")
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return 0, errors.New("Unexpected WebSocket continuation")
+			}
+		default:
+			return 0, errors.New("Unexpected WebSocket frame type")
+		}
+		n += int(size)
+		if fin {
+			return n, nil
+		}
+	}
+}
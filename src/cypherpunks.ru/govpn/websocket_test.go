@@ -0,0 +1,116 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func wsPair(t *testing.T) (*WSConn, *WSConn, func()) {
+	conns := make(chan *WSConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	connC, err := WSDial("ws" + strings.TrimPrefix(srv.URL, "http") + "/govpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connS := <-conns
+	return connC, connS, func() {
+		connC.Close()
+		connS.Close()
+		srv.Close()
+	}
+}
+
+func TestWSMessages(t *testing.T) {
+	connC, connS, done := wsPair(t)
+	defer done()
+	buf := make([]byte, 1<<17)
+	for _, size := range []int{0, 1, 125, 126, 1 << 16, 1<<16 + 1} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		go connC.Write(data)
+		n, err := connS.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], data) {
+			t.Fatal("client->server failed", size, err)
+		}
+		go connS.Write(data)
+		n, err = connC.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], data) {
+			t.Fatal("server->client failed", size, err)
+		}
+	}
+	go connC.Write(make([]byte, 32))
+	if _, err := connS.Read(buf[:16]); err != WSMessageTooBig {
+		t.Fatal("too big message accepted")
+	}
+}
+
+func TestWSControl(t *testing.T) {
+	connC, connS, done := wsPair(t)
+	defer done()
+	go func() {
+		connC.frameWrite(wsOpPing, []byte("ping"))
+		connC.Write([]byte("data"))
+	}()
+	buf := make([]byte, 16)
+	n, err := connS.Read(buf)
+	if err != nil || string(buf[:n]) != "data" {
+		t.Fatal("data after ping is not received", err)
+	}
+	go connS.frameWrite(wsOpClose, nil)
+	if _, err = connC.Read(buf); err == nil {
+		t.Fatal("close frame is ignored")
+	}
+}
+
+func TestWSHandshake(t *testing.T) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	connC, connS, done := wsPair(t)
+	defer done()
+	buf := make([]byte, 2*MTUMax)
+	read := func(conn *WSConn) []byte {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	hsC := HandshakeStart("client", connC, testConf)
+	hsS := NewHandshake("server", connS, testConf)
+	hsS.Server(read(connS))
+	hsC.Client(read(connC))
+	if hsS.Server(read(connS)) == nil {
+		t.Fatal("server failed")
+	}
+	if hsC.Client(read(connC)) == nil {
+		t.Fatal("client failed")
+	}
+}
@@ -10,6 +10,11 @@
 # - GOVPN_IFACE          -- tap device
 # - INTERNAL_IP4_ADDRESS -- e.g. 172.0.0.2/24
 # - INTERNAL_IP4_GATEWAY -- e.g. 172.0.0.1
+#   (GOVPN_IP4_ADDRESS and GOVPN_IP4_GATEWAY pushed by the server
+#   are used by default, if client is started with -pull)
+
+INTERNAL_IP4_ADDRESS=${GOVPN_IP4_ADDRESS:-$INTERNAL_IP4_ADDRESS}
+INTERNAL_IP4_GATEWAY=${GOVPN_IP4_GATEWAY:-$INTERNAL_IP4_GATEWAY}
 
 
 set_up_dev() {
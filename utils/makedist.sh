@@ -10,11 +10,13 @@ release=$1
 git clone . $tmp/govpn-$release
 repos="
     src/github.com/agl/ed25519
-    src/github.com/bigeagle/water
+    src/github.com/cloudflare/circl
     src/github.com/dchest/blake2b
     src/github.com/go-yaml/yaml
     src/github.com/magical/argon2
     src/golang.org/x/crypto
+    src/golang.org/x/net
+    src/golang.org/x/sys
 "
 for repo in $repos; do
     git clone $repo $tmp/govpn-$release/$repo
@@ -29,11 +31,30 @@ golang.org/x/crypto/CONTRIBUTORS
 golang.org/x/crypto/LICENSE
 golang.org/x/crypto/PATENTS
 golang.org/x/crypto/README
+golang.org/x/crypto/argon2
+golang.org/x/crypto/blake2b
+golang.org/x/crypto/chacha20
+golang.org/x/crypto/chacha20poly1305
 golang.org/x/crypto/curve25519
+golang.org/x/crypto/internal
 golang.org/x/crypto/poly1305
 golang.org/x/crypto/salsa20
 golang.org/x/crypto/ssh/terminal
 golang.org/x/crypto/xtea
+golang.org/x/net/AUTHORS
+golang.org/x/net/CONTRIBUTORS
+golang.org/x/net/LICENSE
+golang.org/x/net/PATENTS
+golang.org/x/net/bpf
+golang.org/x/net/internal
+golang.org/x/net/ipv4
+golang.org/x/net/ipv6
+golang.org/x/sys/AUTHORS
+golang.org/x/sys/CONTRIBUTORS
+golang.org/x/sys/LICENSE
+golang.org/x/sys/PATENTS
+golang.org/x/sys/cpu
+golang.org/x/sys/unix
 EOF
 tar cfCI - src $tmp/includes | tar xfC - $tmp
 rm -fr src/golang.org